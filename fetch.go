@@ -5,19 +5,203 @@
    kyle.lafkoff@gmail.com
 
  Usage:
-   go run fetch.go fetch.yaml
+   go run . [flags] fetch.yaml [more.yaml ...]
 
-   go build fetch.go
-   ./fetch fetch.yaml
+   go build -o fetch .
+   ./fetch [flags] fetch.yaml [more.yaml ...]
+   FETCH_CONFIG=fetch.yaml ./fetch [flags]
+
+   go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" -o fetch .
+
+ Flags:
+   -version
+       Print the version, commit and build date and exit
+   -config file
+       Config file, glob pattern or http(s):// URL to load, may be repeated.
+       - reads stdin
+   -config-timeout duration
+       Timeout of downloading a config from a URL (default 10s)
+   -interval duration
+       How often to poll the endpoints and output uptime, e.g. 30s or 1m (default 15s)
+   -timeout duration
+       HTTP request timeout, e.g. 500ms or 2s (default 500ms)
+       Responses slower than this count as DOWN
+   -latency-budget duration
+       Responses slower than this count as DOWN, as slow rather than a timeout,
+       e.g. 500ms with -timeout 5s (default 0, disabled)
+   -latency-alert-p95 duration
+       Flag and notify endpoints whose p95 latency is over this as SLOW, while
+       they stay UP (default 0, disabled)
+   -format text|json|compact
+       Output format for each polling cycle (default text), compact is a single
+       summary line, updated in place on a terminal
+   -tui
+       Show a full-screen table of the endpoints that can be sorted with the
+       keyboard, refreshed every cycle, instead of the text output
+   -no-timestamp
+       Don't print a timestamp before each polling cycle's text output
+   -no-color
+       Don't color the text output by uptime (default when not a terminal)
+   -duration duration
+       Stop after this long, e.g. 10m, print a final summary and exit with a
+       code counting the DOWN endpoints (default forever)
+   -consecutive-failures int
+       Failed checks in a row before an endpoint is notified as DOWN and
+       highlighted, to ignore blips. Every check still counts (default 1)
+   -min-uptime percent
+       With -once or -duration, also count endpoints that finished below this
+       uptime percentage as failed in the exit code (default 0, disabled)
+   -quiet
+       Only print endpoints that are DOWN or below 90% uptime, plus a heartbeat
+   -heartbeat duration
+       How often -quiet prints a heartbeat when everything is healthy (default 5m)
+   -sort name|uptime-asc|uptime-desc
+       Order endpoints are output in, uptime-asc lists the worst first (default name)
+   -aggregate none|total|average
+       Also output the uptime across every endpoint (default none)
+   -filter key=value
+       Only monitor the endpoints with this label, may be repeated to require
+       several (default every endpoint)
+   -group-by label
+       Group the text output by the value of this label (default no grouping)
+   -precision int
+       Decimal places of the uptime percentages in the text and JSON output, e.g.
+       2 for 99.95% (default 0)
+   -window int
+       Report uptime over only the last N attempts, 0 for all time (default 0)
+   -warmup duration
+       Check the endpoints but don't count the checks towards their uptime for
+       this long after startup, e.g. while services boot (default 0)
+   -history-size int
+       Number of recent response times kept per endpoint for percentiles (default 1000)
+   -allow-empty
+       Warn and keep running when the config has no endpoints, e.g. to add them
+       later and reload with SIGHUP, instead of exiting with an error
+   -lint
+       Validate the config and print a report per endpoint without checking anything
+   -once
+       Run a single polling cycle and exit with a code counting the DOWN
+       endpoints
+   -fail-fast
+       With -once, stop the cycle at the first DOWN endpoint and exit with 1
+   -retries int
+       Retry failed requests up to N times within the timeout (default 0)
+   -follow-redirects
+       Follow 3xx redirects, set to false to check the redirect itself (default true)
+   -ca-cert file
+       PEM bundle of additional CA certificates to trust for HTTPS endpoints
+   -log-checks
+       Log a structured JSON event to stderr for every check
+   -concurrency int
+       Maximum number of checks in flight at once, 0 for unlimited (default 0)
+   -shuffle
+       Check the endpoints in a random order every cycle, so none always gets
+       the first or last -concurrency slots
+   -seed int
+       Seed of -shuffle, for a reproducible order (default random)
+   -output file
+       Append the uptime summaries to file instead of stdout, reopening it for
+       every cycle so it can be rotated. Errors still go to stderr
+   -event-socket path
+       Stream each polling cycle's JSON report to clients of a Unix socket
+   -csv-out file
+       Append each polling cycle's results to a CSV file
+   -check-dns
+       Warn at startup about endpoints whose hostname doesn't resolve
+   -webhook-url url
+       POST a JSON notification when an endpoint changes between UP and DOWN
+   -slack-webhook url
+       Post a Slack message when an endpoint changes between UP and DOWN
+   -slack-cooldown duration
+       Minimum time between Slack messages about the same endpoint, the latest
+       change in between is posted once it's over (default 5m)
+   -slack-template template
+       Go text/template of the Slack message text, given the transition
+   -always-send-body
+       Send the body with every method, not only POST, PUT, PATCH and DELETE
+   -allow-custom-methods
+       Accept methods other than the standard ones, e.g. PROPFIND, as written
+   -prefer-head
+       Check GET endpoints with HEAD requests, unless their body is checked,
+       falling back to GET for servers that answer 405 or 501
+   -max-body-bytes int
+       Read at most this many bytes of a response body to check it, the rest is
+       ignored (default 1048576, 1MiB)
+   -count-bytes
+       Count the request and response body bytes of every endpoint in the JSON
+       output and metrics, reading every response body up to -max-body-bytes
+   -any-response-up
+       Count any HTTP response within the timeout as UP, whatever its status code
+   -default-content-type
+       Send bodies as Content-Type application/json unless the headers set one,
+       set to false to send no Content-Type (default true)
+   -verbose
+       Log every request and response to stderr, with secret headers redacted
+   -trace
+       Log how long the DNS lookup, connect, TLS handshake and first byte of
+       every request took to stderr
+   -ip-version auto|4|6
+       Connect to endpoints over only IPv4 or IPv6 (default auto, either)
+   -http-version auto|1.1|2
+       Send every request over only HTTP/1.1 or HTTP/2 (default auto, negotiated)
+   -http3
+       Send https:// requests over HTTP/3 (QUIC), falling back to TCP for an
+       endpoint once it fails
+   -no-keepalive
+       Open a new connection for every request instead of reusing them
+   -proxy url
+       Proxy for every request, overrides HTTP_PROXY/HTTPS_PROXY
+   -socks5 [user:password@]host:port
+       SOCKS5 proxy every HTTP and TCP check connects through
+   -state-file file
+       Save the uptime history every cycle and restore it on startup
+   -request-id-header name
+       Send a unique request ID in this header with every request
+   -request-id-override
+       Replace the request ID header even if the config's headers set it
+   -dedupe strict|loose
+       Drop duplicate endpoints matching on every field or the name only (default strict)
+   -user-agent string
+       User-Agent header sent with every request (default fetch-sre/<version>)
+   -jitter duration
+       Randomly offset each endpoint's checks after the first cycle, and after
+       a reload, by up to this long (default 0)
+   -cycle-timeout duration
+       Cancel checks still running after this long, including retries and
+       waiting for -concurrency, as DOWN (default the endpoint's interval)
+   -metrics-addr address
+       Serve Prometheus metrics on address, e.g. :9100 (default disabled)
+   -status-addr address
+       Serve a status page of every endpoint on address, e.g. :8080 (default disabled)
+   -healthz-max-age duration
+       How recently a check must have completed for the status server's /healthz
+       to answer 200 rather than 503 (default 3 times the longest interval)
 
  About:
    The fetch HTTP HealthCheck program will attempt to connect to the sites
    defined in a yaml file every 15 seconds and report back if UP or DOWN,
-   with a percentage of uptime.
+   with a percentage of uptime. The polling interval can be changed with
+   the -interval flag, and per endpoint with the interval field.
+
+   On SIGINT or SIGTERM in-flight checks are cancelled, a final summary of
+   uptime is printed and the program exits cleanly.
+
+   Invalid flags or config exit with 1, and errors starting up with 2. With
+   -once or -duration the exit code is 2 plus the number of DOWN endpoints,
+   e.g. 3 for one, capped at 125, or 0 if they're all UP.
+
+   On SIGUSR1 the full uptime summary is printed, even with -quiet.
+
+   On SIGHUP the config files are re-read. New endpoints are added, removed
+   ones are dropped and the uptime history of the rest is kept.
+
+   The endpoints are checked by the monitor package, which also
+   documents the fields of the yaml file. This file is the command line.
 
  Criteria for UP:
-   1. 2xx HTTP Response code
-   2. Response returns within the 500ms threshold
+   1. 2xx HTTP Response code (or one of the endpoint's expect_status codes)
+   2. Response returns within the 500ms threshold (see -timeout)
+   3. Response body matches, if expect_body_contains/expect_body_regex is set
 
  See README.md for information on installing dependencies
 */
@@ -26,189 +210,2669 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"context"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	htmltemplate "html/template"
+	"io"
 	"io/ioutil"
+	"log/slog"
 	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
-	"gopkg.in/yaml.v3"
+	"github.com/klafkoff/fetch_sre/monitor"
 )
 
-/*
-YAML file being parsed:
-
-	name (string, required) - A free-text name to describe the HTTP endpoint.
-
-	url (string, required) - The URL of the HTTP endpoint.
-	You may assume that the URL is always a valid HTTP or HTTPS address.
+// stringList is a flag.Value collecting every use of a repeatable flag
+type stringList []string
 
-	method (string, optional) - The HTTP method of the endpoint.
-	If this field is present, you may assume it's a valid HTTP method (e.g. GET, POST, etc.).
-	If this field is omitted, the default is GET.
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
 
-	headers (dictionary, optional) - The HTTP headers to include in the request.
-	If this field is present, you may assume that the keys and values of this dictionary
-	are strings that are valid HTTP header names and values.
-	If this field is omitted, no headers need to be added to or modified in the HTTP
-	request.
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
 
-	body (string, optional) - The HTTP body to include in the request.
-	If this field is present, you should assume it's a valid JSON-encoded string. You
-	do not need to account for non-JSON request bodies.
-	If this field is omitted, no body is sent in the request.
-*/
+// labelSelector is a flag.Value collecting the key=value labels of every use of
+// -filter
+type labelSelector map[string]string
 
-// YAML config file parsed data
-type HealthCheck struct {
-	Body     string            `yaml:"body,omitempty"`
-	Headers  map[string]string `yaml:"headers,omitempty"`
-	Method   string            `yaml:"method,omitempty"`
-	Name     string            `yaml:"name"`
-	URL      string            `yaml:"url"`
-	hostname string            `yaml:"-"`
+func (s labelSelector) String() string {
+	pairs := make([]string, 0, len(s))
+	for key, value := range s {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
 }
 
-// Result is the data structure to store the history of attempts
-type Result struct {
-	Attempt float64
-	Success float64
+func (s labelSelector) Set(value string) error {
+	key, label, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("must be key=value, got %q", value)
+	}
+	if _, dup := s[key]; dup {
+		return fmt.Errorf("label %q is already filtered on", key)
+	}
+	s[key] = label
+	return nil
 }
 
-// Calculate successful percentage of uptime for the domains of each URL
-func (r Result) Uptime() int {
-	if r.Attempt == 0 {
-		return 0
-	}
-	return int(math.Round(100 * (r.Success / r.Attempt)))
+// Report is the JSON document printed for each polling cycle with -format json
+type Report struct {
+	Timestamp time.Time    `json:"timestamp"`
+	Sites     []SiteReport `json:"sites"`
+	Aggregate *float64     `json:"aggregate,omitempty"` // Fleet uptime percentage, see -aggregate and -precision
 }
 
-// Thread-safe structure for tracking percent uptime of domains
-type Results struct {
-	lock  sync.Locker
-	Sites map[string]*Result
+// SiteReport is the uptime of a single endpoint within a Report
+type SiteReport struct {
+	Name         string            `json:"name"`
+	Up           bool              `json:"up"`
+	StatusCode   int               `json:"status_code,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	Host         string            `json:"host"`
+	Uptime       float64           `json:"uptime"` // Percentage with -precision decimals
+	Attempts     int               `json:"attempts"`
+	Successes    int               `json:"successes"`
+	AvgLatencyMs float64           `json:"avg_latency_ms"`
+	P50LatencyMs float64           `json:"p50_latency_ms"`
+	P95LatencyMs float64           `json:"p95_latency_ms"`
+	P99LatencyMs float64           `json:"p99_latency_ms"`
+	Disabled     bool              `json:"disabled,omitempty"`
+	Skipped      bool              `json:"skipped,omitempty"` // The dependency in depends_on isn't UP
+	DependsOn    string            `json:"depends_on,omitempty"`
+	Failures     map[string]int    `json:"failures,omitempty"` // DOWN attempts per error category
+	Consecutive  int               `json:"consecutive_failures,omitempty"`
+	Alerting     bool              `json:"alerting,omitempty"`     // See -consecutive-failures
+	Slow         bool              `json:"slow,omitempty"`         // See -latency-alert-p95
+	Checked      *time.Time        `json:"checked,omitempty"`      // Omitted before the first attempt
+	LastSuccess  *time.Time        `json:"last_success,omitempty"` // Omitted if no attempt was UP
+	Labels       map[string]string `json:"labels,omitempty"`
+
+	// Body totals over every attempt, omitted without -count-bytes
+	BytesSent     int64 `json:"bytes_sent,omitempty"`
+	BytesReceived int64 `json:"bytes_received,omitempty"`
 }
 
-// HTTP Request timeout set in milliseconds
-var responseTimeout int = 500
+// Version of fetch, and the commit and date it was built from. Set at build
+// time with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   string = "dev"
+	commit    string = "unknown"
+	buildDate string = "unknown"
+)
+
+// HTTP Request timeout and UP threshold, overridden with -timeout
+var responseTimeout time.Duration = 500 * time.Millisecond
+
+// Latency over which responses count as DOWN even though they arrived within
+// the timeout, 0 to disable. Overridden with -latency-budget.
+var latencyBudget time.Duration = 0
+
+// p95 latency over which endpoints are highlighted and notified as SLOW, 0 to
+// disable. Overridden with -latency-alert-p95.
+var latencyAlertP95 time.Duration = 0
+
+// Output timeout (polling interval), overridden with -interval
+var outputTimeout time.Duration = 15 * time.Second
+
+// Output format of each polling cycle, overridden with -format
+var outputFormat string = "text"
+
+// Rewrite the -format compact line in place rather than printing a line per
+// cycle, when stdout is a terminal
+var compactInPlace bool = false
+
+// Omit the timestamp header of the text output, enabled with -no-timestamp
+var noTimestamp bool = false
+
+// Unix socket each polling cycle's JSON report is streamed to, set with
+// -event-socket
+var eventSocketPath string = ""
+
+// Clients connected to the -event-socket, nil unless it's set
+var events *eventSocket
+
+// Where the uptime summaries are written, stdout unless -output is set
+var summaryOut io.Writer = os.Stdout
+
+// Color the text output by uptime, disabled with -no-color or when the output isn't a terminal
+var useColor bool = false
+
+// Uptime percentages at or above which text output is green, or else yellow
+const (
+	goodUptime = 90
+	warnUptime = 50
+)
+
+// Only print unhealthy endpoints, enabled with -quiet
+var quiet bool = false
+
+// How often -quiet prints a heartbeat when every endpoint is healthy, set with -heartbeat
+var heartbeatInterval time.Duration = 5 * time.Minute
+
+// When output was last printed, for the -quiet heartbeat
+var lastOutput time.Time
+
+// How the aggregate uptime of every endpoint is calculated, none, total or
+// average. Overridden with -aggregate.
+var aggregateMode string = "none"
+
+// Order endpoints are output in, name, uptime-asc or uptime-desc. Overridden
+// with -sort.
+var sortOrder string = "name"
+
+// Full-screen view redrawn every cycle instead of the text output, started
+// with -tui, nil otherwise
+var screen *tui
+
+// Labels an endpoint must have to be monitored, set with -filter
+var labelFilter = labelSelector{}
+
+// Label the text output is grouped by, set with -group-by
+var groupBy string = ""
+
+// Decimal places of the output uptime percentages, overridden with -precision
+var precision int = 0
+
+// Highest -precision, beyond which float64 percentages aren't exact anyway
+const maxPrecision = 6
+
+// Number of most recent attempts uptime is calculated over, overridden with -window
+var uptimeWindow int = 0
+
+// How long after startup checks don't count towards the uptime, overridden
+// with -warmup
+var warmup time.Duration = 0
+
+// Exit codes, besides the number of DOWN endpoints with -once or -duration
+const (
+	exitOK      = 0 // Success, or every endpoint UP
+	exitConfig  = 1 // Invalid flags or config, including problems found by -lint
+	exitRuntime = 2 // Failed to start, e.g. a server that can't listen
+)
+
+// The number of DOWN endpoints is added to exitDown, so that it can't be
+// confused with the error codes: one DOWN endpoint exits with 3
+const exitDown = exitRuntime
+
+// Highest exit code used to report DOWN endpoints, below the codes shells use
+// for commands that can't run or were killed by a signal
+const maxExitCode = 125
+
+// Exit code of -fail-fast stopping at a DOWN endpoint, that of the one
+// endpoint it found DOWN. Unlike exitConfig it means the config was valid and
+// the checks ran.
+const exitFailFast = exitDown + 1
+
+// Keep running without any endpoints, e.g. to add them later with a reload,
+// enabled with -allow-empty
+var allowEmpty bool = false
+
+// Only validate the config and exit, enabled with -lint
+var lintOnly bool = false
+
+// Run a single polling cycle and exit, enabled with -once
+var runOnce bool = false
+
+// Cancel the rest of the -once cycle at the first DOWN endpoint, enabled with
+// -fail-fast
+var failFast bool = false
+
+// How long to run for before exiting, forever if 0. Set with -duration.
+var runDuration time.Duration = 0
+
+// Consecutive failed checks before an endpoint is alerting, notified as DOWN
+// and highlighted. Overridden with -consecutive-failures.
+var consecutiveFailures int = 1
+
+// Uptime percentage every endpoint must finish a -once or -duration run at or
+// above, 0 to disable. Overridden with -min-uptime.
+var minUptime int = 0
+
+// Number of times a failed request is retried, overridden with -retries
+var maxRetries int = 0
+
+// Check GET endpoints with HEAD requests, falling back to GET for servers
+// that don't support it. Enabled with -prefer-head.
+var preferHead bool = false
+
+// Maximum number of response body bytes read to check the expected body,
+// overridden with -max-body-bytes
+var maxBodyBytes int64 = 1 << 20
+
+// Count the body bytes every endpoint's checks send and receive, enabled with
+// -count-bytes
+var countBytes bool = false
+
+// Count any HTTP response as UP whatever its status code, unless the endpoint
+// overrides it. Enabled with -any-response-up.
+var anyResponseUp bool = false
+
+// Send bodies with Content-Type application/json unless the headers set one,
+// overridden with -default-content-type
+var defaultContentType bool = true
+
+// Follow HTTP redirects, overridden with -follow-redirects
+var followRedirects bool = true
 
-// Output timeout set in seconds
-var outputTimeout int = 15
+// PEM bundle of additional trusted CA certificates, set with -ca-cert
+var caCertFile string = ""
+
+// The system CAs plus those of -ca-cert, loaded at startup. Nil for only the
+// system ones.
+var rootCAs *x509.CertPool
+
+// Largest config downloaded from a URL
+const maxConfigBytes = 10 << 20
+
+// Config files or glob patterns, set with -config and positional arguments
+var configFiles stringList
+
+// Timeout of downloading a config given as a URL, overridden with
+// -config-timeout
+var configTimeout time.Duration = 10 * time.Second
+
+// Logger for an event per check, enabled with -log-checks
+var checkLogger *slog.Logger
+
+// Maximum number of checks in flight at once, overridden with -concurrency
+var concurrency int = 0
+
+// Randomize the order of the checks every cycle, enabled with -shuffle
+var shuffle bool = false
+
+// Seed of -shuffle, 0 for a random one. Set with -seed.
+var seed int64 = 0
+
+// Maximum random delay before each endpoint's checks start, set with -jitter
+var jitter time.Duration = 0
+
+// Deadline of each check including its retries, 0 for the endpoint's interval.
+// Set with -cycle-timeout.
+var cycleTimeout time.Duration = 0
+
+// CSV file each polling cycle's results are appended to, set with -csv-out
+var csvOut string = ""
+
+// HTTP version requests are sent over, auto to negotiate it, 1.1 or 2.
+// Overridden with -http-version.
+var httpVersion string = "auto"
+
+// Send https:// requests over HTTP/3, enabled with -http3
+var useHTTP3 bool = false
+
+// Open a new connection for every request, enabled with -no-keepalive
+var noKeepAlive bool = false
+
+// IP version endpoints are connected over, auto for either, 4 or 6. Overridden
+// with -ip-version.
+var ipVersion string = "auto"
+
+// Resolve every hostname at startup, enabled with -check-dns
+var checkDNS bool = false
+
+// Timeout of each startup DNS lookup
+const dnsTimeout = 5 * time.Second
+
+// URL notified of endpoints changing between UP and DOWN, set with -webhook-url
+var webhookURL string = ""
+
+// Timeout of each webhook notification
+const webhookTimeout = 5 * time.Second
+
+// Longest fetch waits on exit for the queued webhook notifications to be sent
+const drainTimeout = 10 * time.Second
+
+// Most webhook notifications waiting to be sent, newer ones are dropped
+const maxQueuedNotifications = 1000
+
+// Slack incoming webhook URL notified of endpoints changing between UP and
+// DOWN, set with -slack-webhook
+var slackWebhook string = ""
+
+// Minimum time between Slack messages about the same endpoint, overridden
+// with -slack-cooldown
+var slackCooldown time.Duration = 5 * time.Minute
+
+// Text of the Slack messages, executed with the Transition. Overridden with
+// -slack-template.
+var slackTemplate *template.Template
+
+// Send the body with every method rather than only POST, PUT, PATCH and DELETE,
+// enabled with -always-send-body
+var alwaysSendBody bool = false
+
+// Accept non-standard methods in the config, enabled with -allow-custom-methods
+var allowCustomMethods bool = false
+
+// Log every request and response, enabled with -verbose
+var verbose bool = false
+
+// Log the timing breakdown of every request, enabled with -trace
+var traceRequests bool = false
+
+// Proxy for every request, set with -proxy. Overrides the proxy environment variables.
+var proxyURL *url.URL
+
+// SOCKS5 proxy every connection is made through, with an optional username and
+// password. Set with -socks5.
+var socks5URL *url.URL
+
+// File the uptime history is saved to and restored from, set with -state-file
+var stateFile string = ""
+
+// Header a unique ID is sent in with every request, set with -request-id-header
+var requestIDHeader string = ""
+
+// Replace the request ID header even if the config sets it, enabled with -request-id-override
+var requestIDOverride bool = false
+
+// How duplicate endpoints are detected, strict (every field) or loose (name
+// only). Overridden with -dedupe.
+var dedupeMode string = "strict"
+
+// User-Agent header sent with every request, overridden with -user-agent
+var userAgent string = "fetch-sre/" + version
+
+// Address to serve Prometheus metrics on, set with -metrics-addr
+var metricsAddr string = ""
+
+// Address the status page is served on, set with -status-addr
+var statusAddr string = ""
+
+// How recently a check must have completed for /healthz to be OK, 0 for 3
+// times the longest interval. Overridden with -healthz-max-age.
+var healthzMaxAge time.Duration = 0
+
+// Number of recent successful response times kept per endpoint for the latency
+// percentiles, overridden with -history-size
+var historySize int = 1000
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <configFile.yaml>...\n", os.Args[0])
+	fmt.Fprintf(flag.CommandLine.Output(), "The config file is read from $FETCH_CONFIG if none is given.\n")
+	flag.PrintDefaults()
+}
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Printf("Usage: %s <configFile.yaml>\n", os.Args[0])
-		os.Exit(-1)
+	flag.Usage = usage
+	flag.DurationVar(&outputTimeout, "interval", outputTimeout, "how often to poll the endpoints and output uptime, e.g. 30s or 1m")
+	flag.DurationVar(&latencyBudget, "latency-budget", latencyBudget, "responses slower than this count as DOWN but slow rather than timed out, e.g. 500ms with -timeout 5s; 0 disables it")
+	flag.DurationVar(&latencyAlertP95, "latency-alert-p95", latencyAlertP95, "highlight and notify endpoints whose p95 latency is over this as SLOW; 0 disables it")
+	flag.DurationVar(&responseTimeout, "timeout", responseTimeout, "HTTP request timeout, e.g. 500ms or 2s; responses slower than this count as DOWN")
+	flag.StringVar(&outputFormat, "format", outputFormat, "output format for each polling cycle: text, json or compact")
+	flag.BoolVar(&noTimestamp, "no-timestamp", noTimestamp, "don't print a timestamp before each polling cycle's text output")
+	noColor := flag.Bool("no-color", false, "don't color the text output by uptime")
+	flag.BoolVar(&quiet, "quiet", quiet, "only print endpoints that are DOWN or below 90% uptime, plus a periodic heartbeat")
+	flag.DurationVar(&heartbeatInterval, "heartbeat", heartbeatInterval, "how often -quiet prints a heartbeat when every endpoint is healthy")
+	flag.StringVar(&sortOrder, "sort", sortOrder, "order endpoints are output in: name, uptime-asc (worst first) or uptime-desc")
+	flag.StringVar(&aggregateMode, "aggregate", aggregateMode, "also output the uptime across every endpoint: none, total (successes over attempts) or average (of each endpoint's uptime)")
+	flag.Var(labelFilter, "filter", "only monitor the endpoints with the label key=value, may be repeated to require several")
+	flag.StringVar(&groupBy, "group-by", groupBy, "group the text output by the value of this label of the endpoints")
+	flag.IntVar(&precision, "precision", precision, "decimal places of the uptime percentages in the text and JSON output, e.g. 2 for 99.95%")
+	flag.IntVar(&historySize, "history-size", historySize, "number of recent successful response times kept per endpoint for the latency percentiles")
+	flag.IntVar(&uptimeWindow, "window", uptimeWindow, "report uptime over only the last N attempts, 0 for all time")
+	flag.DurationVar(&warmup, "warmup", warmup, "check the endpoints but don't count the checks towards their uptime for this long after startup, e.g. 30s")
+	flag.BoolVar(&allowEmpty, "allow-empty", allowEmpty, "warn and keep running when the config has no endpoints, instead of exiting")
+	flag.BoolVar(&lintOnly, "lint", lintOnly, "validate the config, print a report per endpoint and exit non-zero if it is invalid, without checking anything")
+	flag.BoolVar(&runOnce, "once", runOnce, "run a single polling cycle and exit with a code counting the DOWN endpoints")
+	flag.BoolVar(&failFast, "fail-fast", failFast, "with -once, stop the cycle at the first DOWN endpoint and exit with 1")
+	flag.IntVar(&maxRetries, "retries", maxRetries, "retry failed requests up to N times within the timeout")
+	flag.BoolVar(&preferHead, "prefer-head", preferHead, "check GET endpoints with HEAD to save bandwidth, falling back to GET if the server answers 405 or 501")
+	flag.Int64Var(&maxBodyBytes, "max-body-bytes", maxBodyBytes, "read at most this many bytes of a response body to check expect_body_contains and expect_body_regex against")
+	flag.BoolVar(&countBytes, "count-bytes", countBytes, "count the request and response body bytes of every endpoint in the JSON output and metrics")
+	flag.BoolVar(&anyResponseUp, "any-response-up", anyResponseUp, "count any HTTP response within the timeout as UP whatever its status code, unless an endpoint sets any_response_up")
+	flag.BoolVar(&defaultContentType, "default-content-type", defaultContentType, "send request bodies as Content-Type application/json unless the headers set one")
+	flag.BoolVar(&followRedirects, "follow-redirects", followRedirects, "follow 3xx redirects; when false the redirect response itself is checked")
+	flag.StringVar(&caCertFile, "ca-cert", caCertFile, "PEM bundle of additional CA certificates to trust for HTTPS endpoints")
+	flag.IntVar(&concurrency, "concurrency", concurrency, "maximum number of checks in flight at once, 0 for unlimited")
+	flag.BoolVar(&shuffle, "shuffle", shuffle, "check the endpoints in a random order every cycle, so none always gets the first or last -concurrency slots")
+	flag.Int64Var(&seed, "seed", seed, "seed of -shuffle for a reproducible order, 0 for a random one")
+	flag.StringVar(&csvOut, "csv-out", csvOut, "append each polling cycle's results to this CSV file")
+	flag.BoolVar(&checkDNS, "check-dns", checkDNS, "warn at startup about endpoints whose hostname doesn't resolve")
+	flag.StringVar(&slackWebhook, "slack-webhook", slackWebhook, "post a Slack message to this incoming webhook URL when an endpoint changes between UP and DOWN")
+	flag.DurationVar(&slackCooldown, "slack-cooldown", slackCooldown, "minimum time between Slack messages about the same endpoint, the latest change in between is posted once it's over")
+	slackText := flag.String("slack-template", defaultSlackTemplate, "Go text/template of the Slack message text, with the fields of the webhook payload, e.g. {{.Name}}")
+	flag.StringVar(&webhookURL, "webhook-url", webhookURL, "POST a JSON notification to this URL when an endpoint changes between UP and DOWN")
+	flag.BoolVar(&alwaysSendBody, "always-send-body", alwaysSendBody, "send the configured body with every method, not only POST, PUT, PATCH and DELETE")
+	flag.BoolVar(&allowCustomMethods, "allow-custom-methods", allowCustomMethods, "accept methods other than the standard ones, e.g. PROPFIND, as written")
+	flag.BoolVar(&traceRequests, "trace", traceRequests, "log how long the DNS lookup, connect, TLS handshake and first byte of every request took to stderr")
+	flag.BoolVar(&verbose, "verbose", verbose, "log every request and response to stderr, with secret headers redacted")
+	proxy := flag.String("proxy", "", "proxy URL for every request, overrides HTTP_PROXY/HTTPS_PROXY")
+	socks5 := flag.String("socks5", "", "SOCKS5 proxy every HTTP and TCP check connects through, as [user:password@]host:port")
+	flag.IntVar(&consecutiveFailures, "consecutive-failures", consecutiveFailures, "failed checks in a row before an endpoint is notified as DOWN and highlighted, to ignore blips")
+	flag.IntVar(&minUptime, "min-uptime", minUptime, "with -once or -duration, exit non-zero if any endpoint finished below this uptime percentage")
+	flag.DurationVar(&runDuration, "duration", runDuration, "stop after this long, e.g. 10m, print a final summary and exit with a code counting the DOWN endpoints; 0 runs forever")
+	flag.StringVar(&stateFile, "state-file", stateFile, "save the uptime history to this file every cycle and restore it on startup")
+	flag.StringVar(&requestIDHeader, "request-id-header", requestIDHeader, "send a unique request ID in this header with every request, e.g. X-Fetch-Request-Id")
+	flag.BoolVar(&requestIDOverride, "request-id-override", requestIDOverride, "replace the -request-id-header even if the config's headers set it")
+	flag.StringVar(&httpVersion, "http-version", httpVersion, "send requests over only HTTP/1.1 (1.1), HTTP/2 (2) or whichever is negotiated (auto)")
+	flag.BoolVar(&useHTTP3, "http3", useHTTP3, "send https:// requests over HTTP/3 (QUIC), falling back to TCP for an endpoint once it fails")
+	flag.BoolVar(&noKeepAlive, "no-keepalive", noKeepAlive, "open a new connection for every request instead of reusing them, to test connection setup")
+	flag.StringVar(&ipVersion, "ip-version", ipVersion, "connect to endpoints over only IPv4 (4), IPv6 (6) or either (auto)")
+	flag.StringVar(&dedupeMode, "dedupe", dedupeMode, "drop duplicate endpoints matching on every field (strict) or the name only (loose)")
+	flag.StringVar(&userAgent, "user-agent", userAgent, "User-Agent header sent with every request, unless the endpoint sets one")
+	flag.DurationVar(&jitter, "jitter", jitter, "randomly offset each endpoint's checks by up to this long, e.g. 2s, to spread out the load")
+	flag.DurationVar(&cycleTimeout, "cycle-timeout", cycleTimeout, "cancel checks still running after this long as DOWN, 0 for the endpoint's interval")
+	flag.StringVar(&statusAddr, "status-addr", statusAddr, "serve an HTML or JSON status page of every endpoint on this address, e.g. :8080")
+	flag.DurationVar(&healthzMaxAge, "healthz-max-age", healthzMaxAge, "how recently a check must have completed for /healthz to answer 200, 0 for 3 times the longest interval")
+	flag.StringVar(&metricsAddr, "metrics-addr", metricsAddr, "serve Prometheus metrics on this address, e.g. :9100")
+	logChecks := flag.Bool("log-checks", false, "log a structured JSON event to stderr for every check")
+	flag.StringVar(&eventSocketPath, "event-socket", eventSocketPath, "stream each polling cycle's JSON report, one per line, to every client connected to this Unix socket")
+	useTUI := flag.Bool("tui", false, "show a full-screen table of the endpoints, refreshed every cycle, instead of the text output; press q to quit")
+	outputPath := flag.String("output", "", "append the uptime summaries to this file instead of stdout")
+	flag.Var(&configFiles, "config", "config file, glob pattern or http(s):// URL to load, may be repeated; - reads stdin")
+	flag.DurationVar(&configTimeout, "config-timeout", configTimeout, "timeout of downloading a config from a URL")
+	showVersion := flag.Bool("version", false, "print the version, commit and build date and exit")
+
+	// Invalid flags exit with exitConfig rather than the flag package's 2,
+	// which is exitRuntime
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitConfig)
+	}
+
+	if *showVersion {
+		fmt.Printf("fetch %s\n", buildInfo())
+		os.Exit(exitOK)
+	}
+
+	// NO_COLOR is the common convention to disable colors, see https://no-color.org
+	_, noColorEnv := os.LookupEnv("NO_COLOR")
+	useColor = !*noColor && !noColorEnv && isTerminal(os.Stdout)
+	if *outputPath != "" {
+		summaryOut = appendFile(*outputPath)
+		useColor = false
+	}
+
+	if *logChecks {
+		checkLogger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	}
+
+	if outputFormat != "text" && outputFormat != "json" && outputFormat != "compact" {
+		fmt.Fprintf(os.Stderr, "Error: -format must be text, json or compact, got %q\n", outputFormat)
+		usage()
+		os.Exit(exitConfig)
+	}
+	compactInPlace = outputFormat == "compact" && *outputPath == "" && !runOnce && isTerminal(os.Stdout)
+	if *useTUI && runOnce {
+		fmt.Fprintf(os.Stderr, "Error: -tui can't be used with -once\n")
+		usage()
+		os.Exit(exitConfig)
+	}
+	if *useTUI && outputFormat != "text" {
+		fmt.Fprintf(os.Stderr, "Error: -tui can't be used with -format %s\n", outputFormat)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if *useTUI && (!isTerminal(os.Stdin) || !isTerminal(os.Stdout)) {
+		fmt.Fprintf(os.Stderr, "Error: -tui needs stdin and stdout to be a terminal\n")
+		usage()
+		os.Exit(exitConfig)
+	}
+
+	if sortOrder != "name" && sortOrder != "uptime-asc" && sortOrder != "uptime-desc" {
+		fmt.Fprintf(os.Stderr, "Error: -sort must be name, uptime-asc or uptime-desc, got %q\n", sortOrder)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if aggregateMode != "none" && aggregateMode != "total" && aggregateMode != "average" {
+		fmt.Fprintf(os.Stderr, "Error: -aggregate must be none, total or average, got %q\n", aggregateMode)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if groupBy != "" && !monitor.ValidLabelName(groupBy) {
+		fmt.Fprintf(os.Stderr, "Error: -group-by must be a label name, got %q\n", groupBy)
+		usage()
+		os.Exit(exitConfig)
+	}
+
+	if precision < 0 || precision > maxPrecision {
+		fmt.Fprintf(os.Stderr, "Error: -precision must be between 0 and %d, got %d\n", maxPrecision, precision)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if historySize <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -history-size must be greater than zero, got %d\n", historySize)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if warmup < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -warmup must not be negative, got %s\n", warmup)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if failFast && !runOnce {
+		fmt.Fprintf(os.Stderr, "Error: -fail-fast requires -once\n")
+		usage()
+		os.Exit(exitConfig)
+	}
+	if warmup > 0 && runOnce {
+		fmt.Fprintf(os.Stderr, "Error: -warmup can't be used with -once, its only cycle would never count\n")
+		usage()
+		os.Exit(exitConfig)
+	}
+	if maxBodyBytes <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-body-bytes must be greater than zero, got %d\n", maxBodyBytes)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if uptimeWindow < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -window must not be negative, got %d\n", uptimeWindow)
+		usage()
+		os.Exit(exitConfig)
+	}
+
+	if *proxy != "" {
+		u, err := url.Parse(*proxy)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "Error: -proxy must be a URL such as http://proxy:3128, got %q\n", *proxy)
+			usage()
+			os.Exit(exitConfig)
+		}
+		proxyURL = u
+	}
+	if *socks5 != "" {
+		u, err := url.Parse("socks5://" + *socks5)
+		if err != nil || u.Hostname() == "" || u.Port() == "" || u.Path != "" {
+			fmt.Fprintf(os.Stderr, "Error: -socks5 must be [user:password@]host:port, got %q\n", *socks5)
+			usage()
+			os.Exit(exitConfig)
+		}
+		if proxyURL != nil {
+			fmt.Fprintf(os.Stderr, "Error: -socks5 and -proxy can't both be set\n")
+			usage()
+			os.Exit(exitConfig)
+		}
+		socks5URL = u
+	}
+
+	if dedupeMode != "strict" && dedupeMode != "loose" {
+		fmt.Fprintf(os.Stderr, "Error: -dedupe must be strict or loose, got %q\n", dedupeMode)
+		usage()
+		os.Exit(exitConfig)
+	}
+
+	if latencyBudget < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -latency-budget must not be negative, got %s\n", latencyBudget)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if latencyAlertP95 < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -latency-alert-p95 must not be negative, got %s\n", latencyAlertP95)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if slackCooldown < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -slack-cooldown must not be negative, got %s\n", slackCooldown)
+		usage()
+		os.Exit(exitConfig)
+	}
+	var err error
+	slackTemplate, err = template.New("slack").Parse(*slackText)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -slack-template is invalid: %s\n", err)
+		usage()
+		os.Exit(exitConfig)
+	}
+
+	if httpVersion != "auto" && httpVersion != "1.1" && httpVersion != "2" {
+		fmt.Fprintf(os.Stderr, "Error: -http-version must be auto, 1.1 or 2, got %q\n", httpVersion)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if useHTTP3 && httpVersion != "auto" {
+		fmt.Fprintf(os.Stderr, "Error: -http3 and -http-version %s can't both be set\n", httpVersion)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if useHTTP3 && (proxyURL != nil || socks5URL != nil || noKeepAlive) {
+		fmt.Fprintf(os.Stderr, "Error: -http3 can't be set with -proxy, -socks5 or -no-keepalive\n")
+		usage()
+		os.Exit(exitConfig)
+	}
+	if ipVersion != "auto" && ipVersion != "4" && ipVersion != "6" {
+		fmt.Fprintf(os.Stderr, "Error: -ip-version must be auto, 4 or 6, got %q\n", ipVersion)
+		usage()
+		os.Exit(exitConfig)
+	}
+
+	if jitter < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -jitter must not be negative, got %s\n", jitter)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if configTimeout <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -config-timeout must be greater than zero, got %s\n", configTimeout)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if healthzMaxAge < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -healthz-max-age must not be negative, got %s\n", healthzMaxAge)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if cycleTimeout < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -cycle-timeout must not be negative, got %s\n", cycleTimeout)
+		usage()
+		os.Exit(exitConfig)
+	}
+
+	if consecutiveFailures < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -consecutive-failures must be at least 1, got %d\n", consecutiveFailures)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if minUptime < 0 || minUptime > 100 {
+		fmt.Fprintf(os.Stderr, "Error: -min-uptime must be between 0 and 100, got %d\n", minUptime)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if minUptime > 0 && !runOnce && runDuration == 0 {
+		fmt.Fprintf(os.Stderr, "Error: -min-uptime requires -once or -duration\n")
+		usage()
+		os.Exit(exitConfig)
+	}
+	if runDuration < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -duration must not be negative, got %s\n", runDuration)
+		usage()
+		os.Exit(exitConfig)
+	}
+
+	if concurrency < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -concurrency must not be negative, got %d\n", concurrency)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if seed != 0 && !shuffle {
+		fmt.Fprintf(os.Stderr, "Error: -seed requires -shuffle\n")
+		usage()
+		os.Exit(exitConfig)
+	}
+
+	if maxRetries < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -retries must not be negative, got %d\n", maxRetries)
+		usage()
+		os.Exit(exitConfig)
+	}
+
+	if responseTimeout <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -timeout must be greater than zero, got %s\n", responseTimeout)
+		usage()
+		os.Exit(exitConfig)
+	}
+	if outputTimeout <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -interval must be greater than zero, got %s\n", outputTimeout)
+		usage()
+		os.Exit(exitConfig)
+	}
+
+	// Config files from -config and positional arguments, or else FETCH_CONFIG
+	configFiles = append(configFiles, flag.Args()...)
+	if len(configFiles) < 1 {
+		if config := os.Getenv("FETCH_CONFIG"); config != "" {
+			configFiles = append(configFiles, config)
+		}
+	}
+	if len(configFiles) < 1 {
+		fmt.Fprintf(os.Stderr, "Error: No config file given as an argument, with -config or in FETCH_CONFIG\n")
+		usage()
+		os.Exit(exitConfig)
+	}
+
+	// Trust the system CAs plus any from -ca-cert, also for configs downloaded
+	// from a URL
+	if caCertFile != "" {
+		var err error
+		rootCAs, err = loadCACerts(caCertFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unable to load CA certificates: %s\n", err)
+			os.Exit(exitConfig)
+		}
+	}
+
+	healthcheck, err := loadConfig(configFiles)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(exitConfig)
 	}
 
-	yamlConfigFile := os.Args[1]
-	yamlFile, err := ioutil.ReadFile(yamlConfigFile)
+	// Sanity checks
+	healthcheck = dedupeConfig(healthcheck)
+	if lintOnly {
+		os.Exit(lintConfig(healthcheck))
+	}
+	healthcheck, err = filterConfig(healthcheck)
 	if err != nil {
-		fmt.Printf("Error: Unable to open yaml config file: %s ", err)
-		os.Exit(-1)
+		fmt.Fprintf(os.Stderr, "Error: Invalid yaml config:\n%s\n", err)
+		os.Exit(exitConfig)
+	}
+	if len(healthcheck) == 0 {
+		if !allowEmpty && len(labelFilter) > 0 {
+			fmt.Fprintf(os.Stderr, "Error: No endpoints match -filter %s, see -allow-empty\n", labelFilter)
+			os.Exit(exitConfig)
+		}
+		if !allowEmpty {
+			fmt.Fprintf(os.Stderr, "Error: No endpoints to monitor, see -allow-empty\n")
+			os.Exit(exitConfig)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: No endpoints to monitor, add some and reload the config with SIGHUP\n")
 	}
 
-	var healthcheck []HealthCheck
-	err = yaml.Unmarshal(yamlFile, &healthcheck)
+	m, err := monitor.New(healthcheck, checkOptions())
 	if err != nil {
-		fmt.Printf("Error: Unable to unmarshal/parse yaml config: %s", err)
-		os.Exit(-1)
+		fmt.Fprintf(os.Stderr, "Error: Invalid yaml config:\n%s\n", err)
+		os.Exit(exitConfig)
 	}
+	m.OnResult = logResult
+	m.OnTransition = notify
+	status := m.Results()
+	fmt.Fprintf(os.Stderr, "fetch %s checking %d endpoints\n", buildInfo(), len(healthcheck))
 
-	status := &Results{
-		lock:  new(sync.Mutex),
-		Sites: make(map[string]*Result),
+	if checkDNS {
+		resolveHosts(m.Endpoints())
 	}
 
-	for i, hc := range healthcheck {
-		// Sanity checks
-		if hc.Name == "" {
-			fmt.Printf("Error: Required name not found\n")
-			os.Exit(-1)
+	// Pick up the uptime history from the previous run
+	if stateFile != "" {
+		if err := loadState(stateFile, status); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "Warning: Unable to load state file, starting fresh: %s\n", err)
 		}
-		if hc.URL == "" {
-			fmt.Printf("Error: Required URL not found\n")
-			os.Exit(-1)
+	}
+
+	// Prometheus metrics
+	if metricsAddr != "" {
+		if err := serveMetrics(metricsAddr, status); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unable to start metrics server: %s\n", err)
+			os.Exit(exitRuntime)
 		}
+	}
 
-		// Get the subdomain.domain.whatever
-		// e.g.: http://www.foo.com -> www.foo.com
-		address, err := url.Parse(hc.URL)
+	// JSON event stream
+	if eventSocketPath != "" {
+		events, err = listenEvents(eventSocketPath)
 		if err != nil {
-			fmt.Printf("Error: Cant parse URL: %s", hc.URL)
-			os.Exit(-1)
+			fmt.Fprintf(os.Stderr, "Error: Unable to listen on event socket: %s\n", err)
+			os.Exit(exitRuntime)
 		}
-		healthcheck[i].hostname = address.Hostname()
-		status.Sites[healthcheck[i].hostname] = new(Result)
 	}
 
-	for {
-		wg := new(sync.WaitGroup)
-		wg.Add(len(healthcheck))
-
-		for _, hc := range healthcheck {
-			go func(hc HealthCheck) {
-				success := check(hc)
-				status.lock.Lock()
-				status.Sites[hc.hostname].Attempt++
-				if success {
-					status.Sites[hc.hostname].Success++
-				}
-				status.lock.Unlock()
-				wg.Done()
-			}(hc)
+	// Status page
+	if statusAddr != "" {
+		if err := serveStatus(statusAddr, m); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unable to start status server: %s\n", err)
+			os.Exit(exitRuntime)
+		}
+	}
+
+	// Stop polling cleanly on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Stop polling after -duration, the same way as on a signal
+	if runDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, runDuration)
+		defer cancel()
+	}
+
+	// Reload the config on SIGHUP
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	// Print the full summary on SIGUSR1, e.g. with -quiet
+	dump := make(chan os.Signal, 1)
+	signal.Notify(dump, syscall.SIGUSR1)
+
+	// The TUI replaces the text output, which then only goes to -output
+	var keys <-chan byte
+	resize := make(chan os.Signal, 1)
+	if *useTUI {
+		screen, err = newTUI(status)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unable to start the TUI: %s\n", err)
+			os.Exit(exitRuntime)
+		}
+		defer screen.close()
+		if *outputPath == "" {
+			summaryOut = io.Discard
 		}
-		wg.Wait()
+		keys = screen.keys
+		signal.Notify(resize, syscall.SIGWINCH)
+		screen.draw()
+	}
 
-		// Output percentage of uptime for the domains of each URL
-		for host, res := range status.Sites {
-			fmt.Printf("%s has %d%% availablity percentage\n", host, res.Uptime())
+	// With -fail-fast the first DOWN endpoint cancels the checks still running,
+	// which then don't count, and the partial cycle isn't reported
+	if failFast {
+		cycle, cancel := context.WithCancel(ctx)
+		var once sync.Once
+		var failed monitor.HealthCheck
+		m.OnResult = func(site monitor.HealthCheck, res monitor.CheckResult) {
+			logResult(site, res)
+			if !res.Up {
+				once.Do(func() {
+					failed = site
+					cancel()
+				})
+			}
+		}
+		m.RunOnce(cycle)
+		cancel()
+		if failed.Name != "" {
+			fmt.Fprintf(os.Stderr, "Failing fast, %s (%s) is DOWN\n", failed.Name, failed.URL)
+			exit(exitFailFast)
 		}
+	} else {
+		// The first cycle checks every endpoint before the first output
+		m.RunOnce(ctx)
+	}
+	report(status)
+
+	if runOnce {
+		printMinUptime(status)
+		exit(exitCode(status))
+	}
+
+	// After that every endpoint is checked on its own interval, and the uptime
+	// is output on the global one
+	m.Start(ctx)
+	summary := time.NewTicker(outputTimeout)
+	defer summary.Stop()
 
-		// Delay polling
-		time.Sleep(time.Duration(outputTimeout) * time.Second)
+	for {
+		select {
+		case <-ctx.Done():
+			stop() // A second SIGINT exits without waiting for the notifications
+			m.Stop()
+			if events != nil {
+				events.close()
+			}
+			if screen != nil {
+				screen.close()
+				if *outputPath == "" {
+					summaryOut = os.Stdout
+				}
+			}
+			if outputFormat == "text" {
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					fmt.Fprintf(summaryOut, "Run duration of %s reached, final uptime summary:\n", runDuration)
+				} else {
+					fmt.Fprintf(summaryOut, "Shutting down, final uptime summary:\n")
+				}
+			}
+			output(summaryOut, status, true)
+			if stateFile != "" {
+				if err := saveState(stateFile, status); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: Unable to save state: %s\n", err)
+				}
+			}
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				printMinUptime(status)
+				exit(exitCode(status))
+			}
+			exit(exitOK)
+		case <-hangup:
+			if err := reloadConfig(m); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Unable to reload config, keeping the current one: %s\n", err)
+			}
+			if screen != nil {
+				screen.draw()
+			}
+		case <-summary.C:
+			report(status)
+		case <-dump:
+			output(summaryOut, status, true)
+		case key := <-keys:
+			if !screen.press(key) {
+				stop() // Shut down as on SIGINT
+			}
+		case <-resize:
+			screen.resize()
+			screen.draw()
+		}
 	}
 }
 
-// Simple HTTP request function
-func check(site HealthCheck) bool {
+// Version, commit and build date of fetch, e.g. "1.2.0 (commit abc123, built 2023-01-01T12:00:00Z)"
+func buildInfo() string {
+	return fmt.Sprintf("%s (commit %s, built %s)", version, commit, buildDate)
+}
 
-	// HTTP Client with timeout defined above as global variable responseTimeout
-	client := http.Client{
-		Timeout: time.Duration(responseTimeout) * time.Millisecond,
+// Options the endpoints are checked with, from the flags
+func checkOptions() monitor.Options {
+	return monitor.Options{
+		Timeout:             responseTimeout,
+		Interval:            outputTimeout,
+		LatencyBudget:       latencyBudget,
+		LatencyAlertP95:     latencyAlertP95,
+		Retries:             maxRetries,
+		PreferHead:          preferHead,
+		AnyResponseUp:       anyResponseUp,
+		DefaultContentType:  defaultContentType,
+		AlwaysSendBody:      alwaysSendBody,
+		FollowRedirects:     followRedirects,
+		CustomMethods:       allowCustomMethods,
+		UserAgent:           userAgent,
+		RequestIDHeader:     requestIDHeader,
+		RequestIDOverride:   requestIDOverride,
+		HTTPVersion:         httpVersion,
+		HTTP3:               useHTTP3,
+		DisableKeepAlives:   noKeepAlive,
+		IPVersion:           ipVersion,
+		Proxy:               proxyURL,
+		SOCKS5:              socks5URL,
+		RootCAs:             rootCAs,
+		Concurrency:         concurrency,
+		Shuffle:             shuffle,
+		Seed:                seed,
+		Jitter:              jitter,
+		CycleTimeout:        cycleTimeout,
+		Window:              uptimeWindow,
+		Warmup:              warmup,
+		HistorySize:         historySize,
+		MaxBodyBytes:        maxBodyBytes,
+		CountBytes:          countBytes,
+		ConsecutiveFailures: consecutiveFailures,
+		Verbose:             verbose,
+		Trace:               traceRequests,
+		Log:                 os.Stderr,
 	}
+}
 
-	method := "GET"
-	if site.Method != "" {
-		method = site.Method
+// Load a pool of the system CA certificates plus those in the PEM file
+func loadCACerts(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
 	}
 
-	req, err := http.NewRequest(method, site.URL, bytes.NewBufferString(site.Body))
+	pool, err := x509.SystemCertPool()
 	if err != nil {
-		return false
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
 	}
+	return pool, nil
+}
+
+// Matches ${VAR} references to environment variables in the config
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
 
-	// Add The headers
-	if site.Headers != nil {
-		for k, v := range site.Headers {
-			req.Header.Add(k, v)
+// Replace ${VAR} references with their environment variable values
+func expandEnv(config []byte) []byte {
+	return envVarPattern.ReplaceAllFunc(config, func(match []byte) []byte {
+		name := string(envVarPattern.FindSubmatch(match)[1])
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Warning: Environment variable %s is not set\n", name)
 		}
+		return []byte(value)
+	})
+}
+
+// Start serving Prometheus metrics for status on /metrics in the background
+func serveMetrics(addr string, status *monitor.Results) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
 	}
 
-	resp, err := client.Do(req)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, status)
+	})
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Metrics server stopped: %s\n", err)
+		}
+	}()
+	return nil
+}
+
+// Start serving the status page of status on / in the background, as JSON if
+// the request accepts it or else an HTML table
+func serveStatus(addr string, m *monitor.Monitor) error {
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		return false
+		return err
 	}
 
-	defer resp.Body.Close()
+	status := m.Results()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
 
-	// Response code must be between 200 and 299 otherwise it is considered down
-	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
-		return true
+		status.Lock()
+		names := make([]string, 0, len(status.Sites))
+		for name := range status.Sites {
+			names = append(names, name)
+		}
+		sortNames(names, status)
+		report := newReport(status, names)
+		status.Unlock()
+
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(report)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusPage.Execute(w, report); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unable to render status page: %s\n", err)
+		}
+	})
+
+	// Liveness of fetch itself, e.g. for a load balancer
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		code, message := healthz(m)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		fmt.Fprintf(w, "%s\n", message)
+	})
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Status server stopped: %s\n", err)
+		}
+	}()
+	return nil
+}
+
+// Status code and message of /healthz: 200 if a check has completed within
+// -healthz-max-age, or 503 before the first check and if the checks stalled
+func healthz(m *monitor.Monitor) (int, string) {
+	maxAge := healthzMaxAge
+	if maxAge == 0 {
+		longest := time.Duration(0)
+		for _, hc := range m.Endpoints() {
+			interval := outputTimeout
+			if hc.Interval != "" {
+				interval, _ = time.ParseDuration(hc.Interval)
+			}
+			if hc.IsEnabled() && interval > longest {
+				longest = interval
+			}
+		}
+		maxAge = 3 * longest
+	}
+
+	status := m.Results()
+	status.Lock()
+	defer status.Unlock()
+
+	var last time.Time
+	enabled := 0
+	for _, res := range status.Sites {
+		if res.Disabled {
+			continue
+		}
+		enabled++
+		if res.Checked.After(last) {
+			last = res.Checked
+		}
+	}
+
+	switch {
+	case enabled == 0:
+		return http.StatusOK, "ok: no endpoints to check"
+	case last.IsZero():
+		return http.StatusServiceUnavailable, "starting: no check has completed yet"
+	case time.Since(last) > maxAge:
+		return http.StatusServiceUnavailable, fmt.Sprintf("stalled: the last check completed %s ago, over %s", ago(last), maxAge)
+	}
+	return http.StatusOK, fmt.Sprintf("ok: the last check completed %s ago", ago(last))
+}
+
+// HTML of the -status-addr page, executed with a Report
+var statusPage = htmltemplate.Must(htmltemplate.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="15">
+<title>fetch status</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { padding: 4px 12px; text-align: left; border-bottom: 1px solid #ddd; }
+.up { color: #080; }
+.down { color: #c00; }
+</style>
+</head>
+<body>
+<h1>fetch status</h1>
+<p>As of {{.Timestamp.Format "2006-01-02T15:04:05Z07:00"}}{{with .Aggregate}}, aggregate uptime {{.}}%{{end}}</p>
+<table>
+<tr><th>Name</th><th>Host</th><th>State</th><th>Uptime</th><th>Avg latency</th><th>Last checked</th><th>Last success</th><th>Last error</th></tr>
+{{range .Sites}}<tr>
+<td>{{.Name}}</td>
+<td>{{.Host}}</td>
+{{if .Disabled}}<td>disabled</td>{{else if .Skipped}}<td>skipped, depends on {{.DependsOn}}</td>{{else if .Up}}<td class="up">UP</td>{{else}}<td class="down">DOWN</td>{{end}}
+<td>{{.Uptime}}%</td>
+<td>{{printf "%.1f" .AvgLatencyMs}}ms</td>
+<td>{{with .Checked}}{{.Format "2006-01-02T15:04:05Z07:00"}}{{else}}never{{end}}</td>
+<td>{{with .LastSuccess}}{{.Format "2006-01-02T15:04:05Z07:00"}}{{else}}never{{end}}</td>
+<td>{{.Error}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Write status in the Prometheus text exposition format
+func writeMetrics(w io.Writer, status *monitor.Results) {
+	status.Lock()
+	defer status.Unlock()
+
+	// Disabled endpoints aren't checked, so they have no metrics
+	names := make([]string, 0, len(status.Sites))
+	for name, res := range status.Sites {
+		if !res.Disabled {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	labels := func(name string) string {
+		res := status.Sites[name]
+		pairs := []string{fmt.Sprintf(`name="%s",host="%s"`, escape.Replace(name), escape.Replace(res.Host))}
+		keys := make([]string, 0, len(res.Labels))
+		for key := range res.Labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, key, escape.Replace(res.Labels[key])))
+		}
+		return strings.Join(pairs, ",")
 	}
 
-	return false
+	fmt.Fprintf(w, "# HELP fetch_up Whether the most recent check of the endpoint was UP (1) or DOWN (0).\n")
+	fmt.Fprintf(w, "# TYPE fetch_up gauge\n")
+	for _, name := range names {
+		up := 0
+		if status.Sites[name].Up {
+			up = 1
+		}
+		fmt.Fprintf(w, "fetch_up{%s} %d\n", labels(name), up)
+	}
+
+	// Only endpoints with a depends_on can be skipped
+	var dependents []string
+	for _, name := range names {
+		if status.Sites[name].DependsOn != "" {
+			dependents = append(dependents, name)
+		}
+	}
+	if len(dependents) > 0 {
+		fmt.Fprintf(w, "# HELP fetch_skipped Whether the most recent check of the endpoint was skipped (1) as its depends_on wasn't UP.\n")
+		fmt.Fprintf(w, "# TYPE fetch_skipped gauge\n")
+		for _, name := range dependents {
+			skipped := 0
+			if status.Sites[name].Skipped {
+				skipped = 1
+			}
+			fmt.Fprintf(w, "fetch_skipped{%s} %d\n", labels(name), skipped)
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP fetch_uptime_ratio Ratio of successful checks of the endpoint.\n")
+	fmt.Fprintf(w, "# TYPE fetch_uptime_ratio gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "fetch_uptime_ratio{%s} %g\n", labels(name), status.Sites[name].UptimeRatio())
+	}
+
+	fmt.Fprintf(w, "# HELP fetch_response_seconds Response time of successful checks of the endpoint.\n")
+	fmt.Fprintf(w, "# TYPE fetch_response_seconds histogram\n")
+	for _, name := range names {
+		res := status.Sites[name]
+		buckets := res.Buckets()
+		for i, bound := range monitor.LatencyBuckets {
+			fmt.Fprintf(w, "fetch_response_seconds_bucket{%s,le=\"%g\"} %d\n", labels(name), bound, buckets[i])
+		}
+		fmt.Fprintf(w, "fetch_response_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels(name), int(res.Success))
+		fmt.Fprintf(w, "fetch_response_seconds_sum{%s} %g\n", labels(name), res.Latency.Seconds())
+		fmt.Fprintf(w, "fetch_response_seconds_count{%s} %d\n", labels(name), int(res.Success))
+	}
+
+	if !countBytes {
+		return
+	}
+	fmt.Fprintf(w, "# HELP fetch_sent_bytes_total Request body bytes sent by checks of the endpoint.\n")
+	fmt.Fprintf(w, "# TYPE fetch_sent_bytes_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "fetch_sent_bytes_total{%s} %d\n", labels(name), status.Sites[name].BytesSent)
+	}
+
+	fmt.Fprintf(w, "# HELP fetch_received_bytes_total Response body bytes read by checks of the endpoint.\n")
+	fmt.Fprintf(w, "# TYPE fetch_received_bytes_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "fetch_received_bytes_total{%s} %d\n", labels(name), status.Sites[name].BytesReceived)
+	}
+}
+
+// Log the outcome of a check, as a structured event with -log-checks or else
+// only if it's DOWN
+func logResult(site monitor.HealthCheck, res monitor.CheckResult) {
+	if checkLogger != nil {
+		logCheck(site, res)
+	} else if !res.Up && screen == nil {
+		fmt.Fprintf(os.Stderr, "%s (%s) is DOWN: %s\n", site.Name, site.URL, res.Err)
+	}
+}
+
+// Log a structured event for a single check of an endpoint
+func logCheck(site monitor.HealthCheck, res monitor.CheckResult) {
+	state := "DOWN"
+	if res.Up {
+		state = "UP"
+	}
+
+	attrs := []any{
+		slog.String("name", site.Name),
+		slog.String("url", site.URL),
+		slog.String("method", site.RequestMethod()),
+		slog.Int("status_code", res.StatusCode),
+		slog.Float64("latency_ms", float64(res.Latency)/float64(time.Millisecond)),
+		slog.String("state", state),
+	}
+	if res.Err != nil {
+		attrs = append(attrs, slog.String("error", res.Err.Error()))
+	}
+	if res.Criterion != "" {
+		attrs = append(attrs, slog.String("criterion", res.Criterion))
+	}
+	if res.Category != "" {
+		attrs = append(attrs, slog.String("category", res.Category))
+	}
+	checkLogger.Info("check", attrs...)
+}
+
+// Re-read the config files and reload the monitor with them, keeping the
+// history of endpoints that are still configured. On error the current config
+// is kept.
+func reloadConfig(m *monitor.Monitor) error {
+	for _, file := range configFiles {
+		if file == "-" {
+			return fmt.Errorf("config read from stdin can't be reloaded")
+		}
+	}
+
+	healthcheck, err := loadConfig(configFiles)
+	if err != nil {
+		return err
+	}
+	healthcheck, err = filterConfig(dedupeConfig(healthcheck))
+	if err != nil {
+		return fmt.Errorf("Invalid yaml config:\n%w", err)
+	}
+	if len(healthcheck) == 0 && !allowEmpty {
+		return errors.New("no endpoints to monitor, see -allow-empty")
+	}
+	added, removed, err := m.Reload(healthcheck)
+	if err != nil {
+		return fmt.Errorf("Invalid yaml config:\n%w", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Reloaded config: %d endpoints, added %q, removed %q\n", len(healthcheck), added, removed)
+	return nil
+}
+
+// Warn about every endpoint whose hostname doesn't resolve
+func resolveHosts(healthcheck []monitor.HealthCheck) {
+	network := monitor.Options{IPVersion: ipVersion}.IPNetwork("ip")
+	for _, hc := range healthcheck {
+		if !hc.IsEnabled() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+		_, err := net.DefaultResolver.LookupIP(ctx, network, hc.Hostname())
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s (%s) does not resolve: %s\n", hc.Name, hc.Hostname(), err)
+		}
+	}
+}
+
+// Read and merge the endpoints of every config file, expanding glob patterns.
+// A file named - is read from stdin, and http:// and https:// URLs are
+// downloaded.
+func loadConfig(patterns []string) ([]monitor.HealthCheck, error) {
+	var healthcheck []monitor.HealthCheck
+
+	for _, pattern := range patterns {
+		remote := isConfigURL(pattern)
+		files, err := filepath.Glob(pattern)
+		if err != nil && !remote {
+			return nil, fmt.Errorf("Invalid config file pattern %q: %w", pattern, err)
+		}
+		// Not a glob (or no matches), read it as is to report why it can't be opened
+		if len(files) == 0 || pattern == "-" || remote {
+			files = []string{pattern}
+		}
+
+		for _, file := range files {
+			var yamlFile []byte
+			dir := filepath.Dir(file)
+			if file == "-" {
+				yamlFile, err = ioutil.ReadAll(os.Stdin)
+				file, dir = "stdin", "."
+			} else if remote {
+				yamlFile, err = downloadConfig(file)
+				file, dir = redactURL(file), "."
+			} else {
+				yamlFile, err = ioutil.ReadFile(file)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Unable to open yaml config file: %w", err)
+			}
+
+			entries, err := monitor.Parse(expandEnv(yamlFile))
+			if err != nil {
+				return nil, fmt.Errorf("Unable to unmarshal/parse yaml config %s: %w", file, err)
+			}
+
+			// Paths in a config read from stdin or a URL are relative to the
+			// working directory
+			for i := range entries {
+				entries[i].ConfigDir = dir
+				entries[i].Source = fmt.Sprintf("%s entry %d", file, i+1)
+			}
+			healthcheck = append(healthcheck, entries...)
+		}
+	}
+
+	return healthcheck, nil
+}
+
+// If a config argument is a URL to download rather than a file
+func isConfigURL(config string) bool {
+	return strings.HasPrefix(config, "http://") || strings.HasPrefix(config, "https://")
+}
+
+// Download a config from a URL within -config-timeout, through the -proxy or
+// -socks5 and trusting -ca-cert like the checks. Anything but a 200 response
+// is an error, so a config service's error page isn't parsed, and so is a
+// config over maxConfigBytes.
+func downloadConfig(rawURL string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), configTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "application/yaml, text/yaml, */*")
+
+	resp, err := checkOptions().HTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", redactURL(rawURL), resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxConfigBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxConfigBytes {
+		return nil, fmt.Errorf("%s returned a config over %d bytes", redactURL(rawURL), maxConfigBytes)
+	}
+	return data, nil
+}
+
+// A URL with any password replaced, for messages
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// Drop duplicate endpoints with a warning, keeping the first. With -dedupe
+// strict only entries identical in every field are duplicates, and entries
+// sharing a name but nothing else are left for monitor.Validate to reject. With
+// -dedupe loose entries sharing a name are duplicates.
+func dedupeConfig(healthcheck []monitor.HealthCheck) []monitor.HealthCheck {
+	seen := make(map[string]monitor.HealthCheck)
+	deduped := make([]monitor.HealthCheck, 0, len(healthcheck))
+
+	for _, hc := range healthcheck {
+		first, ok := seen[hc.Name]
+		if hc.Name == "" || !ok {
+			seen[hc.Name] = hc
+			deduped = append(deduped, hc)
+			continue
+		}
+
+		// Compare everything but where the entries were loaded from
+		a, b := first, hc
+		a.Source, b.Source = "", ""
+		if dedupeMode == "loose" || reflect.DeepEqual(a, b) {
+			fmt.Fprintf(os.Stderr, "Warning: %s duplicates %s, ignoring it\n", hc.Source, first.Source)
+			continue
+		}
+		deduped = append(deduped, hc)
+	}
+	return deduped
+}
+
+// Keep only the endpoints with every label of -filter. Their depends_on are
+// checked against the whole config, and dropped if the endpoint they depend on
+// doesn't match, since like a disabled one it's never checked so never DOWN.
+func filterConfig(healthcheck []monitor.HealthCheck) ([]monitor.HealthCheck, error) {
+	if len(labelFilter) == 0 {
+		return healthcheck, nil
+	}
+
+	var errs []error
+	problems := monitor.ValidateDependencies(healthcheck)
+	matches := make(map[string]bool) // Names of the endpoints that match
+	for i, hc := range healthcheck {
+		if hc.MatchesLabels(labelFilter) {
+			matches[hc.Name] = true
+			for _, problem := range problems[i] {
+				errs = append(errs, fmt.Errorf("%s: %w", monitor.EntryName(i, hc), problem))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	var matching []monitor.HealthCheck
+	for _, hc := range healthcheck {
+		if !hc.MatchesLabels(labelFilter) {
+			continue
+		}
+		if hc.DependsOn != "" && !matches[hc.DependsOn] {
+			hc.DependsOn = ""
+		}
+		matching = append(matching, hc)
+	}
+	return matching, nil
+}
+
+// Print whether each entry of the config is valid for -lint, returning the
+// exit code: exitOK if every entry is valid, exitConfig otherwise
+func lintConfig(healthcheck []monitor.HealthCheck) int {
+	code := exitOK
+	for i, problems := range monitor.ValidateEntries(healthcheck, allowCustomMethods) {
+		if len(problems) == 0 {
+			fmt.Printf("OK    %s\n", monitor.EntryName(i, healthcheck[i]))
+			continue
+		}
+		code = exitConfig
+		for _, problem := range problems {
+			fmt.Printf("ERROR %s: %s\n", monitor.EntryName(i, healthcheck[i]), problem)
+		}
+	}
+	if err := monitor.ValidateEnabled(healthcheck); err != nil {
+		fmt.Printf("ERROR %s\n", err)
+		code = exitConfig
+	}
+	return code
+}
+
+// Append a row per endpoint to the CSV file, with a header row if it's new
+func writeCSV(path string, status *monitor.Results) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(file)
+	if info.Size() == 0 {
+		w.Write([]string{"timestamp", "name", "host", "attempts", "successes", "uptime", "avg_latency_ms"})
+	}
+
+	// The rows are in the order of the names, whatever the -sort, so every
+	// cycle's rows come in the same order
+	status.Lock()
+	timestamp := time.Now().Format(time.RFC3339)
+	names := make([]string, 0, len(status.Sites))
+	for name := range status.Sites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		res := status.Sites[name]
+		if res.Disabled {
+			continue
+		}
+		w.Write([]string{
+			timestamp,
+			name,
+			res.Host,
+			strconv.Itoa(int(res.Attempt)),
+			strconv.Itoa(int(res.Success)),
+			strconv.Itoa(res.Uptime()),
+			strconv.FormatFloat(float64(res.AvgLatency())/float64(time.Millisecond), 'f', 1, 64),
+		})
+	}
+	status.Unlock()
+
+	w.Flush()
+	return w.Error()
+}
+
+// Calculate the uptime percentage across every endpoint. -aggregate total is
+// the successes over the attempts of all endpoints, -aggregate average is the
+// mean of the uptime of the endpoints that have been checked, both weighted by
+// the weight of each endpoint. The caller must hold status.lock.
+func aggregateUptime(status *monitor.Results) int {
+	return int(math.Round(100 * aggregateRatio(status)))
+}
+
+// Calculate the ratio (0 to 1) of the uptime across every endpoint, see
+// aggregateUptime. The caller must hold status.lock.
+func aggregateRatio(status *monitor.Results) float64 {
+	var success, attempt, sum, checked float64
+	for _, res := range status.Sites {
+		if res.Disabled {
+			continue
+		}
+		s, a := res.Counts()
+		success += s * res.Weight
+		attempt += a * res.Weight
+		if a > 0 {
+			sum += res.UptimeRatio() * res.Weight
+			checked += res.Weight
+		}
+	}
+
+	if aggregateMode == "average" {
+		if checked == 0 {
+			return 0
+		}
+		return sum / checked
+	}
+	if attempt == 0 {
+		return 0
+	}
+	return success / attempt
+}
+
+// Print the endpoints that finished below -min-uptime to stderr
+func printMinUptime(status *monitor.Results) {
+	status.Lock()
+	defer status.Unlock()
+
+	names := make([]string, 0, len(status.Sites))
+	for name := range status.Sites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		res := status.Sites[name]
+		if !res.Disabled && !res.Skipped && res.Uptime() < minUptime {
+			fmt.Fprintf(os.Stderr, "%s (%s) finished with %d%% uptime, below the -min-uptime of %d%%\n", name, res.Host, res.Uptime(), minUptime)
+		}
+	}
+}
+
+// eventSocket streams the JSON report of every polling cycle to the clients
+// connected to a Unix socket
+type eventSocket struct {
+	listener net.Listener
+	lock     sync.Mutex
+	clients  map[net.Conn]bool
+}
+
+// Timeout of writing an event to a client, so a stuck one can't hold up the rest
+const eventWriteTimeout = time.Second
+
+// Listen on the Unix socket at path and accept clients in the background. A
+// socket left behind by a previous run is replaced.
+func listenEvents(path string) (*eventSocket, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &eventSocket{listener: listener, clients: make(map[net.Conn]bool)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			e.lock.Lock()
+			e.clients[conn] = true
+			e.lock.Unlock()
+		}
+	}()
+	return e, nil
+}
+
+// Write the JSON report of every endpoint as a line to every client,
+// dropping the ones that have disconnected
+func (e *eventSocket) send(status *monitor.Results) {
+	status.Lock()
+	names := make([]string, 0, len(status.Sites))
+	for name := range status.Sites {
+		names = append(names, name)
+	}
+	sortNames(names, status)
+	data, err := json.Marshal(newReport(status, names))
+	status.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Unable to marshal JSON report: %s\n", err)
+		return
+	}
+	data = append(data, '\n')
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for conn := range e.clients {
+		conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if _, err := conn.Write(data); err != nil {
+			conn.Close()
+			delete(e.clients, conn)
+		}
+	}
+}
+
+// Stop accepting clients, disconnect them and remove the socket
+func (e *eventSocket) close() {
+	e.listener.Close()
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for conn := range e.clients {
+		conn.Close()
+		delete(e.clients, conn)
+	}
+}
+
+// Exit code reflecting the latest check of every endpoint: exitDown plus the
+// number of endpoints that are DOWN or below -min-uptime, capped at
+// maxExitCode, or exitOK if all are UP. Endpoints skipped for their depends_on
+// don't count.
+func exitCode(status *monitor.Results) int {
+	status.Lock()
+	defer status.Unlock()
+
+	down := 0
+	for _, res := range status.Sites {
+		if !res.Disabled && !res.Skipped && (!res.Up || res.Uptime() < minUptime) {
+			down++
+		}
+	}
+	if down == 0 {
+		return exitOK
+	}
+	if exitDown+down > maxExitCode {
+		return maxExitCode
+	}
+	return exitDown + down
+}
+
+// Queue a transition to be sent to the configured notification webhooks
+func notify(t monitor.Transition) {
+	if webhookURL != "" {
+		notifications.send(t.Name, func() {
+			if err := postWebhook(webhookURL, t); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Unable to send webhook for %s: %s\n", t.Name, err)
+			}
+		})
+	}
+	if slackWebhook != "" {
+		slackLimit.send(t)
+	}
+}
+
+// Queue a Slack message about a transition, noting how many changes of the
+// endpoint were dropped by the cooldown since the previous one
+func postSlack(t monitor.Transition, suppressed int) {
+	notifications.send(t.Name, func() {
+		message, err := newSlackMessage(t, suppressed)
+		if err == nil {
+			err = postWebhook(slackWebhook, message)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unable to send Slack message for %s: %s\n", t.Name, err)
+		}
+	})
+}
+
+// The webhook notifications of every transition, sent in order
+var notifications = newDeliveryQueue(maxQueuedNotifications)
+
+// deliveryQueue sends notifications one at a time in the order they were
+// queued, in the background, so they can be drained before fetch exits
+type deliveryQueue struct {
+	jobs    chan func()
+	pending sync.WaitGroup // Queued notifications not sent yet
+}
+
+// Start sending the notifications queued, up to size at once
+func newDeliveryQueue(size int) *deliveryQueue {
+	q := &deliveryQueue{jobs: make(chan func(), size)}
+	go func() {
+		for deliver := range q.jobs {
+			deliver()
+			q.pending.Done()
+		}
+	}()
+	return q
+}
+
+// Queue a notification about the endpoint name, dropping it if the queue is full
+func (q *deliveryQueue) send(name string, deliver func()) {
+	q.pending.Add(1)
+	select {
+	case q.jobs <- deliver:
+	default:
+		q.pending.Done()
+		fmt.Fprintf(os.Stderr, "Error: Unable to send notification for %s, %d are already queued\n", name, cap(q.jobs))
+	}
+}
+
+// Wait for the queued notifications to be sent, up to timeout, returning if
+// they all were
+func (q *deliveryQueue) drain(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		q.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Send the queued notifications before exiting with code
+func exit(code int) {
+	slackLimit.flush()
+	if !notifications.drain(drainTimeout) {
+		fmt.Fprintf(os.Stderr, "Warning: Exiting before every notification was sent after waiting %s\n", drainTimeout)
+	}
+	os.Exit(code)
+}
+
+// Default -slack-template
+const defaultSlackTemplate = "{{.Name}} ({{.Host}}) is {{.State}}{{if .Error}}: {{.Error}}{{end}}"
+
+// SlackMessage is the payload of a Slack incoming webhook, see
+// https://api.slack.com/messaging/webhooks
+type SlackMessage struct {
+	Attachments []SlackAttachment `json:"attachments"`
+}
+
+// SlackAttachment is a message attachment, shown with a colored bar
+type SlackAttachment struct {
+	Fallback string       `json:"fallback"`
+	Color    string       `json:"color"`
+	Text     string       `json:"text"`
+	Fields   []SlackField `json:"fields"`
+	Ts       int64        `json:"ts"`
+}
+
+// SlackField is a title and value shown in a table in the attachment
+type SlackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// Format a transition as a Slack message, noting how many changes of the
+// endpoint were dropped by the cooldown since the previous one
+func newSlackMessage(t monitor.Transition, suppressed int) (SlackMessage, error) {
+	var text strings.Builder
+	if err := slackTemplate.Execute(&text, t); err != nil {
+		return SlackMessage{}, err
+	}
+	if suppressed > 0 {
+		fmt.Fprintf(&text, " (%d more changes since the last message)", suppressed)
+	}
+
+	color := "danger"
+	switch t.State {
+	case "UP", "FAST":
+		color = "good"
+	case "SLOW":
+		color = "warning"
+	}
+	return SlackMessage{Attachments: []SlackAttachment{{
+		Fallback: text.String(),
+		Color:    color,
+		Text:     text.String(),
+		Fields: []SlackField{
+			{Title: "Host", Value: t.Host, Short: true},
+			{Title: "State", Value: t.State, Short: true},
+			{Title: "Uptime", Value: fmt.Sprintf("%d%%", t.Uptime), Short: true},
+		},
+		Ts: t.Timestamp.Unix(),
+	}}}, nil
+}
+
+// Rate limit of the Slack messages about each endpoint
+var slackLimit = newCooldown(postSlack)
+
+// cooldown posts one transition per endpoint every slackCooldown, so a
+// flapping endpoint doesn't spam the channel. The latest transition dropped is
+// posted once the cooldown ends, unless the endpoint is back in the state last
+// posted, so the channel always ends up with its current state.
+type cooldown struct {
+	post func(t monitor.Transition, suppressed int)
+
+	lock    sync.Mutex
+	last    map[string]time.Time          // When the endpoint's last transition was posted
+	state   map[string]string             // State of the endpoint's last transition posted
+	dropped map[string]int                // Transitions of the endpoint dropped since then
+	latest  map[string]monitor.Transition // The latest of them, posted when the cooldown ends
+	timers  map[string]*time.Timer        // Ends of the cooldowns with a latest transition
+}
+
+// Rate limit the transitions posted with post
+func newCooldown(post func(t monitor.Transition, suppressed int)) *cooldown {
+	return &cooldown{
+		post:    post,
+		last:    make(map[string]time.Time),
+		state:   make(map[string]string),
+		dropped: make(map[string]int),
+		latest:  make(map[string]monitor.Transition),
+		timers:  make(map[string]*time.Timer),
+	}
+}
+
+// Post the transition, or if the endpoint's cooldown hasn't ended keep it to
+// post once it does
+func (c *cooldown) send(t monitor.Transition) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if last, ok := c.last[t.Name]; ok && t.Timestamp.Sub(last) < slackCooldown {
+		c.dropped[t.Name]++
+		c.latest[t.Name] = t
+		if c.timers[t.Name] == nil {
+			var timer *time.Timer
+			timer = time.AfterFunc(slackCooldown-t.Timestamp.Sub(last), func() {
+				c.lock.Lock()
+				defer c.lock.Unlock()
+				if c.timers[t.Name] == timer { // Not already ended by flush
+					c.end(t.Name, time.Now())
+				}
+			})
+			c.timers[t.Name] = timer
+		}
+		return
+	}
+	c.postLocked(t, t.Timestamp)
+}
+
+// End the cooldown of the endpoint name at now, posting its latest dropped
+// transition unless it's in the state last posted. c.lock must be held.
+func (c *cooldown) end(name string, now time.Time) {
+	delete(c.timers, name)
+	t, ok := c.latest[name]
+	delete(c.latest, name)
+	if ok && t.State != c.state[name] {
+		c.dropped[name]-- // Posted rather than dropped after all
+		c.postLocked(t, now)
+	}
+}
+
+// Post the transition at now, with the number dropped since the last one.
+// c.lock must be held.
+func (c *cooldown) postLocked(t monitor.Transition, now time.Time) {
+	suppressed := c.dropped[t.Name]
+	c.last[t.Name] = now
+	c.state[t.Name] = t.State
+	delete(c.dropped, t.Name)
+	c.post(t, suppressed)
+}
+
+// End every cooldown right away, e.g. before exiting, posting the latest
+// transitions dropped
+func (c *cooldown) flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for name, timer := range c.timers {
+		timer.Stop()
+		c.end(name, time.Now())
+	}
+}
+
+// POST the JSON encoded payload to the webhook URL
+func postWebhook(url string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	// Go through the same proxy and trust the same CAs as the checks, but
+	// negotiate the HTTP version and always follow redirects, as -http-version
+	// and -follow-redirects are about the endpoints
+	opts := checkOptions()
+	opts.HTTPVersion = "auto"
+	client := opts.HTTPClient()
+	client.Timeout = webhookTimeout
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Output the uptime of every endpoint, append it to the CSV file and save the
+// state file if enabled
+func report(status *monitor.Results) {
+	if screen != nil {
+		screen.draw()
+	}
+	output(summaryOut, status, false)
+	if events != nil {
+		events.send(status)
+	}
+	if csvOut != "" {
+		if err := writeCSV(csvOut, status); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unable to write CSV results: %s\n", err)
+		}
+	}
+	if stateFile != "" {
+		if err := saveState(stateFile, status); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unable to save state: %s\n", err)
+		}
+	}
+}
+
+// Write the history of every endpoint to the state file. The file is replaced
+// atomically so a crash mid-write can't corrupt it.
+func saveState(path string, status *monitor.Results) error {
+	status.Lock()
+	saved := make(map[string]monitor.SavedResult, len(status.Sites))
+	for name, res := range status.Sites {
+		saved[name] = res.Save()
+	}
+	data, err := json.Marshal(saved)
+	status.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Restore the history of the configured endpoints from the state file. Saved
+// endpoints that are no longer configured are ignored.
+func loadState(path string, status *monitor.Results) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var saved map[string]monitor.SavedResult
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+
+	status.Lock()
+	defer status.Unlock()
+
+	for name, s := range saved {
+		if res, ok := status.Sites[name]; ok {
+			res.Restore(s)
+		}
+	}
+	return nil
+}
+
+// Write the uptime of every endpoint to w in the configured output format.
+// With -quiet only unhealthy endpoints are written unless full is set, or a
+// heartbeat when there haven't been any for a while.
+func output(w io.Writer, status *monitor.Results, full bool) {
+	status.Lock()
+	defer status.Unlock()
+
+	// A single line whatever -quiet, kept on its own line by the full summary
+	if outputFormat == "compact" {
+		line := compactSummary(status)
+		if compactInPlace {
+			line = "\r" + line + "\033[K"
+		}
+		if !compactInPlace || full {
+			line += "\n"
+		}
+		if _, err := io.WriteString(w, line); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unable to write output: %s\n", err)
+		}
+		return
+	}
+
+	names := make([]string, 0, len(status.Sites))
+	for name, res := range status.Sites {
+		if !full && quiet && (res.Disabled || res.Skipped || res.Up && res.Uptime() >= goodUptime && !res.Slow()) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sortNames(names, status)
+	if groupBy != "" {
+		groupNames(names, status)
+	}
+
+	heartbeat := false
+	if !full && quiet && len(names) == 0 {
+		if time.Since(lastOutput) < heartbeatInterval {
+			return
+		}
+		heartbeat = true
+	}
+	lastOutput = time.Now()
+
+	// Write the whole cycle at once so it isn't interleaved with anything else
+	var buf bytes.Buffer
+	defer func() {
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unable to write output: %s\n", err)
+		}
+	}()
+
+	if outputFormat == "json" {
+		data, err := json.Marshal(newReport(status, names))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unable to marshal JSON report: %s\n", err)
+			return
+		}
+		fmt.Fprintf(&buf, "%s\n", data)
+		return
+	}
+
+	if !noTimestamp {
+		fmt.Fprintf(&buf, "%s\n", time.Now().Format(time.RFC3339))
+	}
+	if heartbeat {
+		enabled := 0
+		for _, res := range status.Sites {
+			if !res.Disabled {
+				enabled++
+			}
+		}
+		fmt.Fprintf(&buf, "All %d endpoints are healthy\n", enabled)
+		return
+	}
+	group := ""
+	for i, name := range names {
+		res := status.Sites[name]
+
+		// With -group-by a heading starts each group, and its endpoints are
+		// indented under it
+		indent := ""
+		if groupBy != "" {
+			if g := groupHeading(res); i == 0 || g != group {
+				group = g
+				fmt.Fprintf(&buf, "%s\n", group)
+			}
+			indent = "  "
+		}
+
+		if res.Disabled {
+			fmt.Fprintf(&buf, "%s%s (%s) is disabled\n", indent, name, res.Host)
+			continue
+		}
+		if res.Skipped {
+			fmt.Fprintf(&buf, "%s%s (%s) is skipped, it depends on %s which isn't UP\n", indent, name, res.Host, res.DependsOn)
+			continue
+		}
+		line := fmt.Sprintf("%s (%s) has %s%% availablity percentage, %s average latency, p50 %s p95 %s p99 %s",
+			name, res.Host, formatPercent(res.UptimeRatio()), res.AvgLatency().Round(time.Millisecond),
+			res.Percentile(50).Round(time.Millisecond), res.Percentile(95).Round(time.Millisecond), res.Percentile(99).Round(time.Millisecond))
+
+		// Why the endpoint is currently failing
+		if !res.Up && res.Attempt > 0 {
+			if res.Criterion == "status" {
+				line += fmt.Sprintf(", DOWN with status %d", res.Status) // The error only repeats it
+			} else if res.Status != 0 {
+				line += fmt.Sprintf(", DOWN with status %d: %s", res.Status, res.Error)
+			} else {
+				line += fmt.Sprintf(", DOWN: %s", res.Error)
+			}
+			if res.Consecutive > 1 {
+				line += fmt.Sprintf(" (%d checks in a row)", res.Consecutive)
+			}
+		}
+
+		// How fresh the state is, and how long the endpoint has been DOWN
+		if res.Checked.IsZero() {
+			line += ", not checked yet"
+		} else {
+			line += fmt.Sprintf(", last checked %s ago", ago(res.Checked))
+			if res.LastSuccess.IsZero() {
+				line += ", never UP"
+			} else {
+				line += fmt.Sprintf(", last success %s ago", ago(res.LastSuccess))
+			}
+		}
+
+		// Breakdown of why the endpoint has failed over the run
+		if verbose && len(res.Failures) > 0 {
+			categories := make([]string, 0, len(res.Failures))
+			for category := range res.Failures {
+				categories = append(categories, category)
+			}
+			sort.Strings(categories)
+			for i, category := range categories {
+				categories[i] = fmt.Sprintf("%s=%d", category, res.Failures[category])
+			}
+			line += ", failures: " + strings.Join(categories, " ")
+		}
+		if res.Slow() {
+			line += fmt.Sprintf(", SLOW: p95 over %s", latencyAlertP95)
+		}
+
+		// Alerting endpoints are red whatever their uptime, and slow ones at
+		// most yellow
+		uptime := res.Uptime()
+		if res.Alerting() {
+			uptime = 0
+		} else if res.Slow() && uptime >= goodUptime {
+			uptime = warnUptime
+		}
+		fmt.Fprintf(&buf, "%s%s\n", indent, colorize(line, uptime))
+	}
+	if aggregateMode != "none" {
+		aggregate := aggregateRatio(status)
+		line := fmt.Sprintf("Aggregate (%s) uptime of %d endpoints is %s%%", aggregateMode, len(status.Sites), formatPercent(aggregate))
+		fmt.Fprintf(&buf, "%s\n", colorize(line, aggregateUptime(status)))
+	}
+}
+
+// Build the JSON report of the named endpoints, with the lock of status held
+func newReport(status *monitor.Results, names []string) Report {
+	report := Report{
+		Timestamp: time.Now(),
+		Sites:     make([]SiteReport, 0, len(names)),
+	}
+	for _, name := range names {
+		res := status.Sites[name]
+		site := SiteReport{
+			Name:         name,
+			Up:           res.Up,
+			StatusCode:   res.Status,
+			Error:        res.Error,
+			Host:         res.Host,
+			Uptime:       res.UptimePercent(precision),
+			Attempts:     int(res.Attempt),
+			Successes:    int(res.Success),
+			AvgLatencyMs: float64(res.AvgLatency()) / float64(time.Millisecond),
+			P50LatencyMs: float64(res.Percentile(50)) / float64(time.Millisecond),
+			P95LatencyMs: float64(res.Percentile(95)) / float64(time.Millisecond),
+			P99LatencyMs: float64(res.Percentile(99)) / float64(time.Millisecond),
+			Disabled:     res.Disabled,
+			Skipped:      res.Skipped,
+			DependsOn:    res.DependsOn,
+			Failures:     res.Failures,
+			Consecutive:  res.Consecutive,
+			Alerting:     res.Alerting(),
+			Slow:         res.Slow(),
+			Labels:       res.Labels,
+
+			BytesSent:     res.BytesSent,
+			BytesReceived: res.BytesReceived,
+		}
+		if !res.Checked.IsZero() {
+			checked := res.Checked
+			site.Checked = &checked
+		}
+		if !res.LastSuccess.IsZero() {
+			success := res.LastSuccess
+			site.LastSuccess = &success
+		}
+		report.Sites = append(report.Sites, site)
+	}
+	if aggregateMode != "none" {
+		aggregate := monitor.Percent(aggregateRatio(status), precision)
+		report.Aggregate = &aggregate
+	}
+	return report
+}
+
+// How long ago a time was in its largest whole unit, e.g. 3m or 2h, for the
+// text output
+func ago(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d/time.Second))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d/time.Minute))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d/time.Hour))
+	}
+	return fmt.Sprintf("%dd", int(d/(24*time.Hour)))
+}
+
+// One line summary of every endpoint for -format compact: how many are UP, the
+// one with the lowest uptime and the highest p95 latency, e.g.
+// "UP 12/15 | worst=api 83% | p95=420ms"
+func compactSummary(status *monitor.Results) string {
+	up, enabled, p95 := 0, 0, time.Duration(0)
+	worst := ""
+	for name, res := range status.Sites {
+		if res.Disabled || res.Skipped {
+			continue
+		}
+		enabled++
+		if res.Up {
+			up++
+		}
+		if latency := res.Percentile(95); latency > p95 {
+			p95 = latency
+		}
+		if worst == "" || res.Uptime() < status.Sites[worst].Uptime() ||
+			res.Uptime() == status.Sites[worst].Uptime() && name < worst {
+			worst = name
+		}
+	}
+
+	line := fmt.Sprintf("UP %d/%d", up, enabled)
+	if worst == "" {
+		return line
+	}
+	uptime := status.Sites[worst].Uptime()
+	line += fmt.Sprintf(" | worst=%s %s%% | p95=%s", worst, formatPercent(status.Sites[worst].UptimeRatio()), p95.Round(time.Millisecond))
+	if up < enabled {
+		uptime = 0
+	}
+	return colorize(line, uptime)
+}
+
+// Format an uptime ratio as a percentage with -precision decimals, without the
+// percent sign
+func formatPercent(ratio float64) string {
+	return strconv.FormatFloat(monitor.Percent(ratio, precision), 'f', precision, 64)
+}
+
+// Sort endpoint names in the -sort order, ties in uptime broken by name
+func sortNames(names []string, status *monitor.Results) {
+	sort.Slice(names, func(i, j int) bool {
+		if sortOrder != "name" {
+			a, b := status.Sites[names[i]].Uptime(), status.Sites[names[j]].Uptime()
+			if a != b {
+				return (a < b) == (sortOrder == "uptime-asc")
+			}
+		}
+		return names[i] < names[j]
+	})
+}
+
+// Order sorted names by their -group-by label, keeping the order within each
+// group, with the endpoints without the label last
+func groupNames(names []string, status *monitor.Results) {
+	sort.SliceStable(names, func(i, j int) bool {
+		a, aok := status.Sites[names[i]].Labels[groupBy]
+		b, bok := status.Sites[names[j]].Labels[groupBy]
+		if aok != bok {
+			return aok
+		}
+		return a < b
+	})
+}
+
+// Heading of the -group-by group of an endpoint in the text output
+func groupHeading(res *monitor.Result) string {
+	if value, ok := res.Labels[groupBy]; ok {
+		return fmt.Sprintf("%s=%s:", groupBy, value)
+	}
+	return fmt.Sprintf("%s not set:", groupBy)
+}
+
+// tui is the full-screen view of -tui: a table of every endpoint, redrawn
+// every cycle and on every key press. The terminal is switched to its
+// alternate screen, and to reading key presses without waiting for enter, with
+// stty so no terminal library is needed.
+type tui struct {
+	status  *monitor.Results
+	keys    chan byte // Key presses read from stdin
+	saved   string    // stty settings restored by close
+	sortBy  byte      // Key of the sort column, see tuiSorts
+	reverse bool
+	rows    int
+	cols    int
+	closed  sync.Once
+}
+
+// Columns the TUI can be sorted by, by key
+var tuiSorts = map[byte]string{'n': "name", 'u': "uptime", 'l': "p95 latency", 's': "state"}
+
+// Switch the terminal to the TUI, until close
+func newTUI(status *monitor.Results) (*tui, error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the terminal settings: %w", err)
+	}
+	// Ctrl-C still sends SIGINT, which shuts down as usual
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return nil, fmt.Errorf("unable to set the terminal settings: %w", err)
+	}
+
+	t := &tui{status: status, keys: make(chan byte), saved: saved, sortBy: 'n'}
+	t.resize()
+	fmt.Print("\033[?1049h\033[?25l") // Alternate screen, hidden cursor
+
+	go func() {
+		key := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(key); err != nil {
+				return
+			}
+			t.keys <- key[0]
+		}
+	}()
+	return t, nil
+}
+
+// Run stty on the terminal of stdin, returning its output
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// Restore the terminal, safe to call more than once
+func (t *tui) close() {
+	t.closed.Do(func() {
+		fmt.Print("\033[?25h\033[?1049l")
+		if _, err := stty(t.saved); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Unable to restore the terminal settings: %s\n", err)
+		}
+	})
+}
+
+// Read the size of the terminal, keeping the last one known if it can't be
+func (t *tui) resize() {
+	size, err := stty("size")
+	if err != nil {
+		return
+	}
+	if _, err := fmt.Sscanf(size, "%d %d", &t.rows, &t.cols); err != nil {
+		t.rows, t.cols = 0, 0
+	}
+}
+
+// Handle a key press, returning false if it quits
+func (t *tui) press(key byte) bool {
+	switch {
+	case key == 'q':
+		return false
+	case key == 'r':
+		t.reverse = !t.reverse
+	case tuiSorts[key] != "":
+		t.sortBy = key
+	default:
+		return true
+	}
+	t.draw()
+	return true
+}
+
+// Redraw the whole screen from the latest results
+func (t *tui) draw() {
+	t.status.Lock()
+	defer t.status.Unlock()
+
+	names := make([]string, 0, len(t.status.Sites))
+	up, enabled := 0, 0
+	for name, res := range t.status.Sites {
+		names = append(names, name)
+		if !res.Disabled && !res.Skipped {
+			enabled++
+			if res.Up {
+				up++
+			}
+		}
+	}
+	t.sort(names)
+
+	// Lines are cut at the width of the terminal, so they don't wrap
+	var buf bytes.Buffer
+	buf.WriteString("\033[H\033[2J")
+	line := func(text string, uptime int) {
+		if runes := []rune(text); t.cols > 0 && len(runes) > t.cols {
+			text = string(runes[:t.cols])
+		}
+		if uptime >= 0 {
+			text = colorize(text, uptime)
+		}
+		buf.WriteString(text + "\n")
+	}
+
+	header := fmt.Sprintf("fetch %s  UP %d/%d  %s", version, up, enabled, time.Now().Format(time.RFC3339))
+	if aggregateMode != "none" {
+		header += fmt.Sprintf("  aggregate (%s) %s%%", aggregateMode, formatPercent(aggregateRatio(t.status)))
+	}
+	line(header, -1)
+	order := "ascending"
+	if t.reverse {
+		order = "descending"
+	}
+	line(fmt.Sprintf("Sorted by %s, %s. Sort by [n]ame, [u]ptime, [l]atency or [s]tate, [r]everse, [q]uit", tuiSorts[t.sortBy], order), -1)
+	line("", -1)
+
+	nameWidth, hostWidth := len("NAME"), len("HOST")
+	for _, name := range names {
+		nameWidth = max(nameWidth, min(len([]rune(name)), tuiNameWidth))
+		hostWidth = max(hostWidth, min(len([]rune(t.status.Sites[name].Host)), tuiNameWidth))
+	}
+	row := func(name, host, state, uptime, avg, p95, checked, lastError string) string {
+		return fmt.Sprintf("%-*s  %-*s  %-8s  %8s  %8s  %8s  %7s  %s",
+			nameWidth, truncate(name, nameWidth), hostWidth, truncate(host, hostWidth), state, uptime, avg, p95, checked, lastError)
+	}
+	line(row("NAME", "HOST", "STATE", "UPTIME", "AVG", "P95", "CHECKED", "LAST ERROR"), -1)
+
+	// Endpoints that don't fit on the screen are summarized in a last line
+	shown := len(names)
+	if free := t.rows - 5; t.rows > 0 && shown > free {
+		shown = max(free, 0)
+	}
+	for _, name := range names[:shown] {
+		res := t.status.Sites[name]
+		state, _ := tuiState(res)
+		checked := "never"
+		if !res.Checked.IsZero() {
+			checked = ago(res.Checked)
+		}
+		lastError := res.Error
+		if res.Up || res.Skipped {
+			lastError = ""
+		}
+		text := row(name, res.Host, state, formatPercent(res.UptimeRatio())+"%",
+			res.AvgLatency().Round(time.Millisecond).String(), res.Percentile(95).Round(time.Millisecond).String(), checked, lastError)
+
+		// Colored like the text output, endpoints that aren't checked aren't
+		uptime := res.Uptime()
+		switch {
+		case res.Disabled || res.Skipped || res.Checked.IsZero():
+			uptime = -1
+		case res.Alerting():
+			uptime = 0
+		case res.Slow() && uptime >= goodUptime:
+			uptime = warnUptime
+		}
+		line(text, uptime)
+	}
+	if shown < len(names) {
+		line(fmt.Sprintf("... and %d more endpoints, enlarge the terminal to see them", len(names)-shown), -1)
+	}
+
+	// Without a newline after the last line a full screen doesn't scroll
+	os.Stdout.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+// Widest name or host shown in the TUI, longer ones are truncated
+const tuiNameWidth = 40
+
+// Cut text to width runes, marking that it was cut with an ellipsis
+func truncate(text string, width int) string {
+	runes := []rune(text)
+	if len(runes) <= width {
+		return text
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+// State of an endpoint in the TUI, and its rank when sorting by state, the
+// most urgent first
+func tuiState(res *monitor.Result) (string, int) {
+	switch {
+	case res.Disabled:
+		return "DISABLED", 5
+	case res.Skipped:
+		return "SKIPPED", 2
+	case res.Checked.IsZero():
+		return "PENDING", 3
+	case !res.Up:
+		return "DOWN", 0
+	case res.Slow():
+		return "SLOW", 1
+	}
+	return "UP", 4
+}
+
+// Sort endpoint names by the TUI's sort column, ties broken by name. Uptime
+// sorts the worst first, and latency the slowest first.
+func (t *tui) sort(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		a, b := t.status.Sites[names[i]], t.status.Sites[names[j]]
+		order := 0
+		switch t.sortBy {
+		case 'u':
+			order = cmp.Compare(a.UptimeRatio(), b.UptimeRatio())
+		case 'l':
+			order = cmp.Compare(b.Percentile(95), a.Percentile(95))
+		case 's':
+			_, rankA := tuiState(a)
+			_, rankB := tuiState(b)
+			order = cmp.Compare(rankA, rankB)
+		}
+		if order == 0 {
+			order = strings.Compare(names[i], names[j])
+		}
+		if t.reverse {
+			return order > 0
+		}
+		return order < 0
+	})
+}
+
+// ANSI escape codes for the text output colors
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+)
+
+// Color a line of output by uptime: green at or above goodUptime, yellow at or
+// above warnUptime and red below that
+func colorize(line string, uptime int) string {
+	if !useColor {
+		return line
+	}
+
+	color := colorRed
+	if uptime >= goodUptime {
+		color = colorGreen
+	} else if uptime >= warnUptime {
+		color = colorYellow
+	}
+	return color + line + colorReset
+}
+
+// appendFile is an io.Writer that opens the file for appending on every
+// write, so after it's rotated the next write creates a new one
+type appendFile string
+
+func (path appendFile) Write(p []byte) (int, error) {
+	file, err := os.OpenFile(string(path), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := file.Write(p)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// If the file is a terminal rather than a regular file or pipe
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
 }
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/klafkoff/fetch_sre/monitor"
+)
+
+// A post func recording what the cooldown posted
+type posted struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (p *posted) post(t monitor.Transition, suppressed int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.messages = append(p.messages, fmt.Sprintf("%s +%d", t.State, suppressed))
+}
+
+func (p *posted) get() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string(nil), p.messages...)
+}
+
+func TestCooldown(t *testing.T) {
+	defer func(saved time.Duration) { slackCooldown = saved }(slackCooldown)
+	slackCooldown = 50 * time.Millisecond
+
+	tests := []struct {
+		name   string
+		states []string // Sent in quick succession, within the cooldown
+		want   []string // Posted, with the number of changes dropped before each
+	}{
+		{"single", []string{"DOWN"}, []string{"DOWN +0"}},
+		{"latest posted when it ends", []string{"DOWN", "UP"}, []string{"DOWN +0", "UP +0"}},
+		{"only the latest", []string{"DOWN", "UP", "DOWN", "UP"}, []string{"DOWN +0", "UP +2"}},
+		{"back in the state posted", []string{"DOWN", "UP", "DOWN"}, []string{"DOWN +0"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var p posted
+			c := newCooldown(p.post)
+			for _, state := range test.states {
+				c.send(monitor.Transition{Name: "site", State: state, Timestamp: time.Now()})
+			}
+			time.Sleep(3 * slackCooldown)
+			if got := p.get(); !equalStrings(got, test.want) {
+				t.Errorf("posted %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	// The dropped changes are counted in the next message after the cooldown
+	var p posted
+	c := newCooldown(p.post)
+	for _, state := range []string{"DOWN", "UP", "DOWN"} {
+		c.send(monitor.Transition{Name: "site", State: state, Timestamp: time.Now()})
+	}
+	time.Sleep(3 * slackCooldown)
+	c.send(monitor.Transition{Name: "site", State: "UP", Timestamp: time.Now()})
+	if got, want := p.get(), []string{"DOWN +0", "UP +2"}; !equalStrings(got, want) {
+		t.Errorf("posted %q, want %q", got, want)
+	}
+}
+
+func TestCooldownFlush(t *testing.T) {
+	defer func(saved time.Duration) { slackCooldown = saved }(slackCooldown)
+	slackCooldown = time.Hour
+
+	var p posted
+	c := newCooldown(p.post)
+	for _, state := range []string{"DOWN", "UP", "DOWN", "UP"} {
+		c.send(monitor.Transition{Name: "site", State: state, Timestamp: time.Now()})
+	}
+	c.flush()
+	if got, want := p.get(), []string{"DOWN +0", "UP +2"}; !equalStrings(got, want) {
+		t.Errorf("posted %q, want %q", got, want)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFilterConfigDependencies(t *testing.T) {
+	defer func(saved labelSelector) { labelFilter = saved }(labelFilter)
+	labelFilter = labelSelector{"team": "payments"}
+
+	payments := map[string]string{"team": "payments"}
+	infra := map[string]string{"team": "infra"}
+	healthcheck := []monitor.HealthCheck{
+		{Name: "gateway", Labels: infra},
+		{Name: "db", Labels: payments},
+		{Name: "app", Labels: payments, DependsOn: "gateway"},
+		{Name: "worker", Labels: payments, DependsOn: "db"},
+	}
+
+	matching, err := filterConfig(healthcheck)
+	if err != nil {
+		t.Fatalf("filterConfig: %s", err)
+	}
+	dependsOn := make(map[string]string)
+	for _, hc := range matching {
+		dependsOn[hc.Name] = hc.DependsOn
+	}
+	want := map[string]string{"db": "", "app": "", "worker": "db"}
+	if !reflect.DeepEqual(dependsOn, want) {
+		t.Errorf("filtered depends_on = %v, want %v", dependsOn, want)
+	}
+	if healthcheck[2].DependsOn != "gateway" {
+		t.Errorf("filterConfig changed the unfiltered config")
+	}
+
+	// Unknown dependencies are still errors, but only of matching endpoints
+	healthcheck = append(healthcheck,
+		monitor.HealthCheck{Name: "ignored", Labels: infra, DependsOn: "nothing"},
+		monitor.HealthCheck{Name: "broken", Labels: payments, DependsOn: "nothing"},
+	)
+	if _, err := filterConfig(healthcheck); err == nil || !strings.Contains(err.Error(), "(broken)") || strings.Contains(err.Error(), "(ignored)") {
+		t.Errorf("filterConfig error = %v, want one about broken only", err)
+	}
+}
+
+// Receiver of webhook requests, recording their decoded bodies
+type hooks struct {
+	lock     sync.Mutex
+	requests []*http.Request
+	bodies   []map[string]interface{}
+}
+
+func (h *hooks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.requests = append(h.requests, r)
+	h.bodies = append(h.bodies, body)
+}
+
+func (h *hooks) get() ([]*http.Request, []map[string]interface{}) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]*http.Request(nil), h.requests...), append([]map[string]interface{}(nil), h.bodies...)
+}
+
+func TestNotifyWebhook(t *testing.T) {
+	defer func(saved string, follow bool) { webhookURL, followRedirects = saved, follow }(webhookURL, followRedirects)
+
+	// The webhook is redirected, which is followed even though the checks
+	// aren't
+	var received hooks
+	mux := http.NewServeMux()
+	mux.Handle("/hooks", &received)
+	mux.Handle("/", http.RedirectHandler("/hooks", http.StatusTemporaryRedirect))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	webhookURL = server.URL + "/notify"
+	followRedirects = false
+
+	timestamp := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	notify(monitor.Transition{Name: "api", Host: "api.example.com", State: "DOWN", Timestamp: timestamp, Error: "unexpected status code 503", Uptime: 97})
+	if !notifications.drain(time.Second) {
+		t.Fatalf("the webhook wasn't sent")
+	}
+
+	requests, bodies := received.get()
+	if len(requests) != 1 {
+		t.Fatalf("%d webhook requests, want 1", len(requests))
+	}
+	if r := requests[0]; r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("sent as %s with Content-Type %q, want a POST of application/json", r.Method, r.Header.Get("Content-Type"))
+	}
+	want := map[string]interface{}{
+		"name":      "api",
+		"host":      "api.example.com",
+		"state":     "DOWN",
+		"timestamp": "2026-10-14T12:00:00Z",
+		"error":     "unexpected status code 503",
+		"uptime":    float64(97),
+	}
+	if !reflect.DeepEqual(bodies[0], want) {
+		t.Errorf("payload %v, want %v", bodies[0], want)
+	}
+}
+
+func TestNotifyThroughProxy(t *testing.T) {
+	defer func(hook, slack string, proxy *url.URL) {
+		webhookURL, slackWebhook, proxyURL = hook, slack, proxy
+	}(webhookURL, slackWebhook, proxyURL)
+	defer func(saved *cooldown, text *template.Template) { slackLimit, slackTemplate = saved, text }(slackLimit, slackTemplate)
+	slackLimit = newCooldown(postSlack)
+	slackTemplate = template.Must(template.New("slack").Parse(defaultSlackTemplate))
+
+	// The proxy gets the requests for the webhooks' hosts, which don't resolve
+	var received hooks
+	proxy := httptest.NewServer(&received)
+	defer proxy.Close()
+	proxyURL, _ = url.Parse(proxy.URL)
+	webhookURL = "http://hooks.invalid/notify"
+	slackWebhook = "http://slack.invalid/services/T000/B000/XXXX"
+
+	notify(monitor.Transition{Name: "api", State: "DOWN", Timestamp: time.Now()})
+	if !notifications.drain(time.Second) {
+		t.Fatalf("the notifications weren't sent")
+	}
+
+	requests, _ := received.get()
+	var sent []string
+	for _, r := range requests {
+		sent = append(sent, r.Method+" "+r.URL.String())
+	}
+	sort.Strings(sent)
+	if want := []string{"POST " + webhookURL, "POST " + slackWebhook}; !equalStrings(sent, want) {
+		t.Errorf("the proxy got %q, want %q", sent, want)
+	}
+}
+
+func TestSlackCooldown(t *testing.T) {
+	defer func(saved string) { slackWebhook = saved }(slackWebhook)
+	defer func(saved *cooldown, text *template.Template) { slackLimit, slackTemplate = saved, text }(slackLimit, slackTemplate)
+	defer func(saved time.Duration) { slackCooldown = saved }(slackCooldown)
+	slackCooldown = 50 * time.Millisecond
+	slackLimit = newCooldown(postSlack)
+	slackTemplate = template.Must(template.New("slack").Parse(defaultSlackTemplate))
+
+	var received hooks
+	server := httptest.NewServer(&received)
+	defer server.Close()
+	slackWebhook = server.URL
+
+	// A flapping endpoint posts its first change, and its latest once the
+	// cooldown ends with how many were dropped
+	for _, state := range []string{"DOWN", "UP", "DOWN", "UP"} {
+		notify(monitor.Transition{Name: "api", Host: "api.example.com", State: state, Timestamp: time.Now()})
+	}
+	time.Sleep(3 * slackCooldown)
+	if !notifications.drain(time.Second) {
+		t.Fatalf("the Slack messages weren't sent")
+	}
+
+	_, bodies := received.get()
+	var messages []string
+	for _, body := range bodies {
+		attachment := body["attachments"].([]interface{})[0].(map[string]interface{})
+		messages = append(messages, fmt.Sprintf("%s: %s", attachment["color"], attachment["text"]))
+	}
+	if len(messages) != 2 || !strings.HasPrefix(messages[0], "danger: ") || !strings.HasPrefix(messages[1], "good: ") ||
+		!strings.HasSuffix(messages[1], " (2 more changes since the last message)") {
+		t.Errorf("posted %q, want the DOWN and then the UP with 2 more changes", messages)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		down, up int
+		want     int
+	}{
+		{0, 3, exitOK},
+		{1, 2, 3},
+		{2, 0, 4},
+		{123, 1, 125},
+		{500, 0, maxExitCode},
+	}
+	for _, test := range tests {
+		status := &monitor.Results{Sites: make(map[string]*monitor.Result)}
+		for i := 0; i < test.down; i++ {
+			status.Sites[fmt.Sprintf("down %d", i)] = &monitor.Result{Attempt: 1}
+		}
+		for i := 0; i < test.up; i++ {
+			status.Sites[fmt.Sprintf("up %d", i)] = &monitor.Result{Up: true, Attempt: 1, Success: 1}
+		}
+
+		// Disabled endpoints and those skipped for their depends_on don't count
+		status.Sites["disabled"] = &monitor.Result{Disabled: true}
+		status.Sites["skipped"] = &monitor.Result{Skipped: true, Attempt: 1}
+
+		if got := exitCode(status); got != test.want {
+			t.Errorf("%d DOWN and %d UP: exit code %d, want %d", test.down, test.up, got, test.want)
+		}
+	}
+	if exitFailFast == exitConfig || exitFailFast == exitRuntime {
+		t.Errorf("-fail-fast exits with %d, the code of an error", exitFailFast)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	status := &monitor.Results{Sites: map[string]*monitor.Result{
+		"web":   {Host: "www.example.com", Up: true, Attempt: 2, Success: 2, Latency: 30 * time.Millisecond},
+		"api":   {Host: "api.example.com", Attempt: 2, Success: 1, Latency: 10 * time.Millisecond},
+		"cache": {Host: "cache.example.com", Disabled: true},
+		"db":    {Host: "db.example.com", Up: true, Attempt: 2, Success: 2},
+	}}
+
+	// Every cycle appends its rows in the same order, after a single header
+	path := filepath.Join(t.TempDir(), "results.csv")
+	for i := 0; i < 2; i++ {
+		if err := writeCSV(path, status); err != nil {
+			t.Fatalf("writeCSV: %s", err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("reading the CSV: %s", err)
+	}
+	var got []string
+	for _, row := range rows {
+		got = append(got, strings.Join(row[1:], ","))
+	}
+	cycle := []string{
+		"api,api.example.com,2,1,50,10.0",
+		"db,db.example.com,2,2,100,0.0",
+		"web,www.example.com,2,2,100,15.0",
+	}
+	want := append(append([]string{"name,host,attempts,successes,uptime,avg_latency_ms"}, cycle...), cycle...)
+	if !equalStrings(got, want) {
+		t.Errorf("wrote the rows %q, want %q", got, want)
+	}
+}
+
+func TestQuietHeartbeat(t *testing.T) {
+	defer func(q, ts bool, last time.Time) { quiet, noTimestamp, lastOutput = q, ts, last }(quiet, noTimestamp, lastOutput)
+	quiet, noTimestamp = true, true
+	lastOutput = time.Time{}
+
+	// Disabled endpoints aren't checked, so they aren't counted as healthy
+	status := &monitor.Results{Sites: map[string]*monitor.Result{
+		"api":   {Up: true, Attempt: 1, Success: 1},
+		"web":   {Up: true, Attempt: 1, Success: 1},
+		"cache": {Disabled: true},
+	}}
+	var buf strings.Builder
+	output(&buf, status, false)
+	if got, want := buf.String(), "All 2 endpoints are healthy\n"; got != want {
+		t.Errorf("heartbeat %q, want %q", got, want)
+	}
+
+	// Until the next heartbeat is due nothing is written
+	buf.Reset()
+	output(&buf, status, false)
+	if got := buf.String(); got != "" {
+		t.Errorf("wrote %q right after the heartbeat, want nothing", got)
+	}
+}
+
+func TestOutputLastCheckedAndSuccess(t *testing.T) {
+	defer func(saved bool) { noTimestamp = saved }(noTimestamp)
+	noTimestamp = true
+
+	now := time.Now()
+	status := &monitor.Results{Sites: map[string]*monitor.Result{
+		"api":   {Up: true, Attempt: 1, Success: 1, Checked: now.Add(-5 * time.Second), LastSuccess: now.Add(-5 * time.Second)},
+		"db":    {Attempt: 2, Success: 1, Error: "connection refused", Checked: now.Add(-10 * time.Second), LastSuccess: now.Add(-3 * time.Minute)},
+		"queue": {Attempt: 1, Error: "connection refused", Checked: now.Add(-10 * time.Second)},
+		"web":   {},
+	}}
+	var buf strings.Builder
+	output(&buf, status, true)
+
+	// Every line has them, UP or DOWN
+	want := []string{
+		"api (", ", last checked 5s ago, last success 5s ago",
+		"db (", ", DOWN: connection refused, last checked 10s ago, last success 3m ago",
+		"queue (", ", DOWN: connection refused, last checked 10s ago, never UP",
+		"web (", ", not checked yet",
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(want)/2 {
+		t.Fatalf("wrote %q, want %d lines", lines, len(want)/2)
+	}
+	for i, line := range lines {
+		if prefix, suffix := want[2*i], want[2*i+1]; !strings.HasPrefix(line, prefix) || !strings.HasSuffix(line, suffix) {
+			t.Errorf("line %q, want it to start with %q and end with %q", line, prefix, suffix)
+		}
+	}
+}
@@ -0,0 +1,2923 @@
+/*
+Package monitor checks HTTP and TCP endpoints and keeps the uptime history of
+each of them. It's what the fetch command runs, and can be imported to monitor
+endpoints from other Go programs:
+
+	endpoints, err := monitor.Parse(yamlFile)
+	...
+	m, err := monitor.New(endpoints, monitor.DefaultOptions())
+	...
+	m.OnResult = func(site monitor.HealthCheck, res monitor.CheckResult) {
+		fmt.Println(site.Name, res.Up, res.Latency)
+	}
+	m.Run(ctx)
+
+Run checks every endpoint right away and then on its interval until the
+context is done. The history of every endpoint is kept in Results.
+
+YAML file being parsed:
+
+	name (string, required) - A free-text name to describe the HTTP endpoint.
+	Names must be unique, uptime is tracked and reported per name. Exact duplicate
+	entries are ignored with a warning, see -dedupe.
+
+	url (string, required) - The URL of the HTTP endpoint.
+	You may assume that the URL is always a valid HTTP or HTTPS address.
+	For tcp endpoints this is the address to connect to as tcp://host:port.
+	A URL containing {{ is a Go text/template rendered before every check, e.g. to
+	bust caches with https://fetch.com/?t={{.Timestamp}}. The variables are
+	.Timestamp, the Unix time in seconds, and .Counter, the number of the
+	endpoint's check starting at 1.
+
+	type (string, optional) - The kind of check, http or tcp. A tcp endpoint is UP
+	when a TCP connection to its host and port succeeds within the timeout, the
+	HTTP specific fields are ignored.
+	If this field is omitted, the default is http.
+
+	method (string, optional) - The HTTP method of the endpoint.
+	If this field is present, it must be one of GET, HEAD, POST, PUT, PATCH, DELETE,
+	OPTIONS, TRACE or CONNECT, in any case and with surrounding whitespace ignored.
+	Other methods are rejected unless Options.CustomMethods is set, and are sent as written.
+	If this field is omitted, the default is GET.
+	A HEAD endpoint is UP on its status code, latency and headers alone, so it
+	can't set expect_body_contains, expect_body_regex or expect_sha256.
+
+	headers (dictionary, optional) - The HTTP headers to include in the request.
+	If this field is present, you may assume that the keys and values of this dictionary
+	are strings that are valid HTTP header names and values.
+	If this field is omitted, no headers need to be added to or modified in the HTTP
+	request.
+
+	body (string, optional) - The HTTP body to include in the request.
+	If this field is present, you should assume it's a valid JSON-encoded string. You
+	do not need to account for non-JSON request bodies.
+	If this field is omitted, no body is sent in the request.
+	The body is sent with "Content-Type: application/json" unless headers sets a
+	Content-Type or -default-content-type is false.
+	The body is only sent with POST, PUT, PATCH and DELETE requests unless
+	-always-send-body is set; a warning is printed for other methods.
+
+	body_file (string, optional) - A file containing the HTTP body to include in the
+	request, instead of body. Relative paths are relative to the config file's
+	directory. The file is read on every request. Only one of body and body_file
+	may be set.
+
+	Any ${VAR} in the file is replaced with the value of the environment variable VAR
+	before parsing, e.g. "Authorization: Bearer ${API_TOKEN}". Unset variables are
+	replaced with an empty string and a warning is printed.
+
+	user_agent (string, optional) - The User-Agent header to send, unless headers
+	sets one. If this field is omitted, the global -user-agent is used.
+
+	basic_auth (dictionary, optional) - The username and password to authenticate with
+	using HTTP basic authentication.
+
+	bearer_token (string, optional) - The token to authenticate with as
+	"Authorization: Bearer <token>".
+
+	oauth2 (dictionary, optional) - OAuth2 client credentials to get bearer tokens
+	with from a token endpoint: token_url, client_id, client_secret and optionally
+	a list of scopes. A token is requested before the first check and reused
+	until shortly before it expires, or the endpoint answers 401 Unauthorized.
+	The token endpoint is requested through the same proxy and TLS settings as
+	the endpoint. If a token can't be got the endpoint is DOWN.
+
+	Only one of basic_auth, bearer_token and oauth2 may be set. Any of them
+	replaces an Authorization header set in headers.
+
+	enabled (bool, optional) - Set to false to stop checking the endpoint without
+	removing it from the config. It is output as disabled and doesn't count towards
+	the exit code or aggregate uptime. At least one endpoint must be enabled.
+	If this field is omitted, the endpoint is enabled.
+
+	timeout (string, optional) - The HTTP request timeout for this endpoint as a
+	duration string (e.g. 500ms, 2s). Responses slower than this count as DOWN.
+	If this field is omitted, the global -timeout is used.
+
+	interval (string, optional) - How often this endpoint is checked as a duration
+	string (e.g. 5s, 1m). Uptime is still output on the global -interval.
+	If this field is omitted, the global -interval is used.
+
+	retries (int, optional) - How many times a failed request is retried before the
+	endpoint counts as DOWN. All retries share the endpoint's timeout.
+	If this field is omitted, the global -retries is used.
+
+	follow_redirects (bool, optional) - Whether 3xx redirects are followed. When false
+	the redirect response itself is checked against the UP criteria.
+	If this field is omitted, the global -follow-redirects is used.
+
+	use_cookie_jar (bool, optional) - Keep the cookies the endpoint sets and send
+	them with its later requests, e.g. for a session cookie set by the first one.
+	This makes the checks stateful, so they may not see what a new client would.
+	Cookies are discarded when the config is reloaded.
+	If this field is omitted, no cookies are kept.
+
+	weight (number, optional) - How much the endpoint counts towards the aggregate
+	uptime, e.g. 5 for a critical endpoint or 0 to leave it out. Must not be negative.
+	If this field is omitted, the weight is 1.
+
+	depends_on (string, optional) - The name of another endpoint this one depends on,
+	e.g. the gateway of its database. While the dependency's most recent check is
+	DOWN, or it's skipped itself, the endpoint isn't checked: it's reported as
+	skipped instead of DOWN, and doesn't count towards its uptime or trigger
+	notifications. RunOnce checks the dependency first, so the first cycle and
+	-once already skip it. Dependencies can't form a cycle. A disabled dependency
+	doesn't affect the endpoint.
+	If this field is omitted, the endpoint is always checked.
+
+	labels (dictionary, optional) - Free-form labels of the endpoint, e.g. team:
+	payments or env: production, to select endpoints with -filter and group the
+	output with -group-by. They're added to the JSON output and the Prometheus
+	metrics, so keys must be valid Prometheus label names, and can't be name, host
+	or le, which fetch already uses.
+	If this field is omitted, the endpoint has no labels.
+
+	insecure_skip_verify (bool, optional) - Skip verification of the endpoint's TLS
+	certificate, e.g. for self-signed certificates. Only use this when needed.
+	If this field is omitted, certificates are verified.
+
+	client_cert, client_key (string, optional) - PEM files of the client certificate
+	and its private key to present to the endpoint, for mutual TLS. Relative paths
+	are relative to the config file's directory. Both must be set together.
+
+	expect_content_type (string, optional) - The media type the response's
+	Content-Type header must start with for the endpoint to be UP, e.g.
+	application/json, ignoring parameters such as charset and case.
+	If this field is omitted, the content type isn't checked.
+
+	expect_body_contains (string, optional) - A substring the response body must
+	contain for the endpoint to be UP.
+
+	expect_body_regex (string, optional) - A regular expression the response body
+	must match for the endpoint to be UP.
+
+	expect_sha256 (string, optional) - The hex encoded SHA-256 of the whole response
+	body, after decompression, for the endpoint to be UP, e.g. to catch corrupted
+	or wrong content served with a 200. A body of -max-body-bytes or more is DOWN
+	since it can't be hashed whole. If this field is omitted, nothing is hashed.
+
+	expect_status (int or list of ints, optional) - The HTTP status codes for which the
+	endpoint is UP, e.g. 401 or [200, 204, 301]. Codes must be between 100 and 599.
+	If this field is omitted, any 2xx status code is UP.
+
+	any_response_up (bool, optional) - Count any HTTP response within the timeout
+	as UP whatever its status code, ignoring expect_status, e.g. for gateways that
+	return 4xx by design. The other expect_ fields still apply.
+	If this field is omitted, the global -any-response-up is used.
+
+	Only the first -max-body-bytes of the response body, 1MiB by default, are read and
+	checked against expect_body_contains, expect_body_regex and expect_sha256, so a
+	huge response can't exhaust the memory. If all of them are omitted, the
+	response body isn't read.
+	gzip and deflate compressed bodies are decompressed before they're checked, and
+	a body that fails to decompress counts as DOWN.
+
+	Instead of a list the file may be a mapping of the endpoints and defaults for
+	every one of them. Fields an endpoint doesn't set are taken from defaults, and
+	mappings such as headers are merged key by key, the endpoint's values winning.
+	defaults may set any field but name:
+
+	defaults:
+	  timeout: 2s
+	  headers:
+	    accept: application/json
+	endpoints:
+	  - name: fetch index page
+	    url: https://fetch.com/
+
+	Anchors, aliases and merge keys such as <<: *name can share fields between
+	endpoints, in either form of the file. Fields an endpoint merges in win over
+	defaults, the same as the ones it sets itself.
+
+The global -flags are those of the fetch command, which sets the matching
+Options.
+*/
+package monitor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"gopkg.in/yaml.v3"
+)
+
+// HealthCheck is an endpoint of the YAML config
+type HealthCheck struct {
+	AnyResponseUp      *bool              `yaml:"any_response_up,omitempty"`
+	BasicAuth          *BasicAuth         `yaml:"basic_auth,omitempty"`
+	BearerToken        string             `yaml:"bearer_token,omitempty"`
+	Body               string             `yaml:"body,omitempty"`
+	BodyFile           string             `yaml:"body_file,omitempty"`
+	ClientCert         string             `yaml:"client_cert,omitempty"`
+	ClientKey          string             `yaml:"client_key,omitempty"`
+	DependsOn          string             `yaml:"depends_on,omitempty"`
+	Enabled            *bool              `yaml:"enabled,omitempty"`
+	ExpectBodyContains string             `yaml:"expect_body_contains,omitempty"`
+	ExpectBodyRegex    string             `yaml:"expect_body_regex,omitempty"`
+	ExpectContentType  string             `yaml:"expect_content_type,omitempty"`
+	ExpectSHA256       string             `yaml:"expect_sha256,omitempty"`
+	ExpectStatus       StatusCodes        `yaml:"expect_status,omitempty"`
+	FollowRedirects    *bool              `yaml:"follow_redirects,omitempty"`
+	Headers            map[string]string  `yaml:"headers,omitempty"`
+	InsecureSkipVerify bool               `yaml:"insecure_skip_verify,omitempty"`
+	Interval           string             `yaml:"interval,omitempty"`
+	Labels             map[string]string  `yaml:"labels,omitempty"`
+	Method             string             `yaml:"method,omitempty"`
+	Name               string             `yaml:"name"`
+	OAuth2             *OAuth2            `yaml:"oauth2,omitempty"`
+	Retries            *int               `yaml:"retries,omitempty"`
+	Timeout            string             `yaml:"timeout,omitempty"`
+	Type               string             `yaml:"type,omitempty"`
+	URL                string             `yaml:"url"`
+	UseCookieJar       bool               `yaml:"use_cookie_jar,omitempty"`
+	UserAgent          string             `yaml:"user_agent,omitempty"`
+	Weight             *float64           `yaml:"weight,omitempty"`
+	ConfigDir          string             `yaml:"-"` // Directory of the config file it was loaded from, relative paths are resolved against it
+	Source             string             `yaml:"-"` // Config file and entry it was loaded from, for error messages
+	bodyRegex          *regexp.Regexp     `yaml:"-"`
+	checks             *atomic.Uint64     `yaml:"-"` // Number of checks, for the URL's .Counter
+	noHead             *atomic.Bool       `yaml:"-"` // The server turned down HEAD, see Options.PreferHead
+	client             Doer               `yaml:"-"` // Sends the requests, see newClient
+	clientCert         *tls.Certificate   `yaml:"-"`
+	hostname           string             `yaml:"-"`
+	http3              *http3Transport    `yaml:"-"` // Sends the https:// requests over HTTP/3, nil unless Options.HTTP3
+	interval           time.Duration      `yaml:"-"`
+	opts               *Options           `yaml:"-"` // Options of the Monitor it was prepared for
+	timeout            time.Duration      `yaml:"-"`
+	tokens             *tokenSource       `yaml:"-"` // OAuth2 access tokens, nil unless OAuth2 is set
+	transport          *http.Transport    `yaml:"-"`
+	urlTemplate        *template.Template `yaml:"-"` // Set if the URL is a template
+}
+
+// Config is a config file, either a bare list of endpoints or a mapping of the
+// endpoints and the defaults of every one of them
+type Config struct {
+	Defaults  yaml.Node   `yaml:"defaults"`
+	Endpoints []yaml.Node `yaml:"endpoints"`
+}
+
+// Accept either a list of endpoints or a mapping with defaults
+func (c *Config) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		return value.Decode(&c.Endpoints)
+	}
+
+	type config Config // Without this method, so it isn't called again
+	return value.Decode((*config)(c))
+}
+
+// Parse the endpoints of a YAML config file, with the defaults applied
+func Parse(data []byte) ([]HealthCheck, error) {
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return config.healthChecks()
+}
+
+// Decode the endpoints with the defaults applied
+func (c Config) healthChecks() ([]HealthCheck, error) {
+	defaults := expandMerge(&c.Defaults)
+	if defaults.Kind != 0 && defaults.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: defaults must be a mapping", defaults.Line)
+	}
+	for i := 0; i+1 < len(defaults.Content); i += 2 {
+		if defaults.Content[i].Value == "name" {
+			return nil, fmt.Errorf("line %d: defaults can't set name", defaults.Content[i].Line)
+		}
+	}
+
+	healthcheck := make([]HealthCheck, len(c.Endpoints))
+	for i := range c.Endpoints {
+		if err := mergeDefaults(defaults, &c.Endpoints[i]).Decode(&healthcheck[i]); err != nil {
+			return nil, err
+		}
+		healthcheck[i].Method = normalizeMethod(healthcheck[i].Method)
+	}
+	return healthcheck, nil
+}
+
+// Trim the method, and uppercase it if it's a standard one in another case, so
+// e.g. "get " is GET. Custom methods are case-sensitive and kept as written.
+func normalizeMethod(method string) string {
+	method = strings.TrimSpace(method)
+	if upper := strings.ToUpper(method); knownMethods[upper] {
+		return upper
+	}
+	return method
+}
+
+// Add the keys of the defaults mapping the entry doesn't set to a copy of it,
+// merging the mappings both set in the same way
+func mergeDefaults(defaults, entry *yaml.Node) *yaml.Node {
+	entry = expandMerge(entry)
+	defaults = expandMerge(defaults)
+	if defaults.Kind != yaml.MappingNode || entry.Kind != yaml.MappingNode {
+		return entry
+	}
+
+	merged := *entry
+	merged.Content = append([]*yaml.Node(nil), entry.Content...)
+	for i := 0; i+1 < len(defaults.Content); i += 2 {
+		key, value := defaults.Content[i], defaults.Content[i+1]
+		found := false
+		for j := 0; j+1 < len(merged.Content); j += 2 {
+			if merged.Content[j].Value == key.Value {
+				merged.Content[j+1] = mergeDefaults(value, merged.Content[j+1])
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged.Content = append(merged.Content, key, value)
+		}
+	}
+	return &merged
+}
+
+// A copy of a mapping with its merge keys such as <<: *name replaced by the
+// keys they merge in that it doesn't set itself, earlier merged mappings
+// winning, so defaults only fill in what neither sets. Other nodes, and
+// mappings with invalid merges for Decode to report, are returned as they are.
+func expandMerge(node *yaml.Node) *yaml.Node {
+	node = resolveAlias(node)
+	if node.Kind != yaml.MappingNode {
+		return node
+	}
+
+	var explicit, merges []*yaml.Node
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], resolveAlias(node.Content[i+1])
+		switch {
+		case key.Kind != yaml.ScalarNode || key.Tag != "!!merge":
+			explicit = append(explicit, node.Content[i], node.Content[i+1])
+		case value.Kind == yaml.SequenceNode:
+			merges = append(merges, value.Content...)
+		default:
+			merges = append(merges, value)
+		}
+	}
+	if len(merges) == 0 {
+		return node
+	}
+
+	expanded := *node
+	expanded.Content = explicit
+	for _, merge := range merges {
+		merge = expandMerge(merge)
+		if merge.Kind != yaml.MappingNode {
+			return node
+		}
+		for i := 0; i+1 < len(merge.Content); i += 2 {
+			if !hasKey(&expanded, merge.Content[i].Value) {
+				expanded.Content = append(expanded.Content, merge.Content[i], merge.Content[i+1])
+			}
+		}
+	}
+	return &expanded
+}
+
+// If a mapping sets the key
+func hasKey(mapping *yaml.Node, key string) bool {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return true
+		}
+	}
+	return false
+}
+
+// The node an alias such as *name refers to, or the node itself
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+// BasicAuth is the HTTP basic authentication credentials of an endpoint
+type BasicAuth struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// OAuth2 is the client credentials an endpoint gets its bearer tokens with
+type OAuth2 struct {
+	TokenURL     string   `yaml:"token_url"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Scopes       []string `yaml:"scopes,omitempty"`
+}
+
+// StatusCodes is a list of HTTP status codes, parsed from a single code or a list
+type StatusCodes []int
+
+// Accept either a single status code or a list of them
+func (s *StatusCodes) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var code int
+		if err := value.Decode(&code); err != nil {
+			return err
+		}
+		*s = StatusCodes{code}
+		return nil
+	}
+
+	var codes []int
+	if err := value.Decode(&codes); err != nil {
+		return err
+	}
+	*s = codes
+	return nil
+}
+
+// If the status code is UP: any with any_response_up, one of the expected
+// codes if configured, otherwise 2xx
+func (hc HealthCheck) expectedStatus(code int) bool {
+	anyResponse := hc.opts.AnyResponseUp
+	if hc.AnyResponseUp != nil {
+		anyResponse = *hc.AnyResponseUp
+	}
+	if anyResponse {
+		return true
+	}
+	if len(hc.ExpectStatus) == 0 {
+		return code >= 200 && code <= 299
+	}
+	for _, expected := range hc.ExpectStatus {
+		if code == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// Path of the endpoint's body_file, resolved relative to its config file
+func (hc HealthCheck) BodyFilePath() string {
+	return hc.configPath(hc.BodyFile)
+}
+
+// Path of a file set in the endpoint's config, resolved relative to its config file
+func (hc HealthCheck) configPath(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(hc.ConfigDir, file)
+}
+
+// URLVars are the variables of a templated URL
+type URLVars struct {
+	Timestamp int64  // Unix time in seconds
+	Counter   uint64 // Number of the endpoint's check, starting at 1
+}
+
+// Parse the URL as a template, or nil if it isn't one
+func (hc HealthCheck) parseURLTemplate() (*template.Template, error) {
+	if !strings.Contains(hc.URL, "{{") {
+		return nil, nil
+	}
+	return template.New(hc.Name).Parse(hc.URL)
+}
+
+// Render a templated URL with the variables
+func renderURL(tmpl *template.Template, vars URLVars) (string, error) {
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, vars); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+// The URL of the endpoint, rendered with example variables if it's a template,
+// for validating it and finding its hostname
+func (hc HealthCheck) ExampleURL() (string, error) {
+	tmpl, err := hc.parseURLTemplate()
+	if err != nil || tmpl == nil {
+		return hc.URL, err
+	}
+	return renderURL(tmpl, URLVars{Timestamp: time.Now().Unix(), Counter: 1})
+}
+
+// Hostname of the endpoint's URL, e.g. www.foo.com for http://www.foo.com,
+// once it's prepared by New
+func (hc HealthCheck) Hostname() string {
+	return hc.hostname
+}
+
+// Load the endpoint's client_cert and client_key pair
+func (hc HealthCheck) LoadClientCert() (tls.Certificate, error) {
+	return tls.LoadX509KeyPair(hc.configPath(hc.ClientCert), hc.configPath(hc.ClientKey))
+}
+
+// If the request should include the configured body. Only methods that
+// conventionally carry one do, unless Options.AlwaysSendBody is set.
+func (hc HealthCheck) sendsBody() bool {
+	if hc.opts.AlwaysSendBody {
+		return true
+	}
+	switch hc.RequestMethod() {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// If any of the expect_ fields need the response body
+func (hc HealthCheck) checksBody() bool {
+	return hc.ExpectBodyContains != "" || hc.ExpectBodyRegex != "" || hc.ExpectSHA256 != ""
+}
+
+// If the endpoint has every label of selector with the same value, which is
+// true of every endpoint if selector is empty
+func (hc HealthCheck) MatchesLabels(selector map[string]string) bool {
+	for key, value := range selector {
+		if label, ok := hc.Labels[key]; !ok || label != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Weight of the endpoint in the aggregate uptime, 1 unless configured
+func (hc HealthCheck) AggregateWeight() float64 {
+	if hc.Weight != nil {
+		return *hc.Weight
+	}
+	return 1
+}
+
+// If the endpoint is checked, true unless disabled in the config
+func (hc HealthCheck) IsEnabled() bool {
+	return hc.Enabled == nil || *hc.Enabled
+}
+
+// HTTP method of the endpoint, GET unless configured
+func (hc HealthCheck) RequestMethod() string {
+	if hc.Method != "" {
+		return hc.Method
+	}
+	return "GET"
+}
+
+// Timeout of a request to the endpoint, Options.Timeout unless it overrides it
+func (hc HealthCheck) requestTimeout() time.Duration {
+	if hc.timeout > 0 {
+		return hc.timeout
+	}
+	return hc.opts.Timeout
+}
+
+// How often the endpoint is checked, Options.Interval unless it overrides it
+func (hc HealthCheck) checkInterval() time.Duration {
+	if hc.interval > 0 {
+		return hc.interval
+	}
+	return hc.opts.Interval
+}
+
+// Deadline of a whole check of the endpoint, Options.CycleTimeout if it's set
+// or else its interval, so a check never runs into the next one
+func (hc HealthCheck) cycleTimeout() time.Duration {
+	if hc.opts.CycleTimeout > 0 {
+		return hc.opts.CycleTimeout
+	}
+	return hc.checkInterval()
+}
+
+// Check every entry of the config, returning all of the problems found. Methods
+// other than the standard ones are accepted if customMethods is set.
+func Validate(healthcheck []HealthCheck, customMethods bool) error {
+	var errs []error
+	for i, problems := range ValidateEntries(healthcheck, customMethods) {
+		for _, problem := range problems {
+			errs = append(errs, fmt.Errorf("%s: %w", EntryName(i, healthcheck[i]), problem))
+		}
+	}
+	if err := ValidateEnabled(healthcheck); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// At least one endpoint must be checked
+func ValidateEnabled(healthcheck []HealthCheck) error {
+	for _, hc := range healthcheck {
+		if hc.IsEnabled() {
+			return nil
+		}
+	}
+	if len(healthcheck) == 0 {
+		return nil
+	}
+	return errors.New("every endpoint is disabled, at least one must be enabled")
+}
+
+// Where an entry of the config came from and its name, for error messages
+func EntryName(i int, hc HealthCheck) string {
+	entry := hc.Source
+	if entry == "" {
+		entry = fmt.Sprintf("entry %d", i+1)
+	}
+	if hc.Name != "" {
+		entry = fmt.Sprintf("%s (%s)", entry, hc.Name)
+	}
+	return entry
+}
+
+// Check every entry of the config, returning the problems found with each. Methods
+// other than the standard ones are accepted if customMethods is set.
+func ValidateEntries(healthcheck []HealthCheck, customMethods bool) [][]error {
+	entries := make([][]error, len(healthcheck))
+	names := make(map[string]string)
+
+	for i, hc := range healthcheck {
+		var problems []error
+
+		if hc.Name == "" {
+			problems = append(problems, errors.New("required name not found"))
+		} else if first, ok := names[hc.Name]; ok {
+			problems = append(problems, fmt.Errorf("duplicate name, already defined in %s", first))
+		} else {
+			names[hc.Name] = EntryName(i, hc)
+		}
+
+		if hc.Type != "" && hc.Type != "http" && hc.Type != "tcp" {
+			problems = append(problems, fmt.Errorf("type must be http or tcp, got %q", hc.Type))
+		}
+
+		rawURL, templateErr := hc.ExampleURL()
+		if hc.URL == "" {
+			problems = append(problems, errors.New("required URL not found"))
+		} else if templateErr != nil {
+			problems = append(problems, fmt.Errorf("invalid URL template: %w", templateErr))
+		} else if address, err := url.Parse(rawURL); err != nil {
+			problems = append(problems, fmt.Errorf("cant parse URL %q: %w", hc.URL, err))
+		} else if hc.Type == "tcp" {
+			if address.Scheme != "tcp" || address.Hostname() == "" || address.Port() == "" {
+				problems = append(problems, fmt.Errorf("URL %q is not a valid tcp://host:port address", hc.URL))
+			}
+		} else if (address.Scheme != "http" && address.Scheme != "https") || address.Hostname() == "" {
+			problems = append(problems, fmt.Errorf("URL %q is not a valid HTTP or HTTPS address", hc.URL))
+		}
+
+		if hc.Method != "" && !validMethod(hc.Method) {
+			problems = append(problems, fmt.Errorf("invalid method %q", hc.Method))
+		} else if hc.Method != "" && !knownMethods[hc.Method] && !customMethods {
+			problems = append(problems, fmt.Errorf("unknown method %q, see -allow-custom-methods", hc.Method))
+		}
+
+		if hc.Timeout != "" {
+			if timeout, err := time.ParseDuration(hc.Timeout); err != nil || timeout <= 0 {
+				problems = append(problems, fmt.Errorf("invalid timeout %q", hc.Timeout))
+			}
+		}
+
+		if hc.Interval != "" {
+			if interval, err := time.ParseDuration(hc.Interval); err != nil || interval <= 0 {
+				problems = append(problems, fmt.Errorf("invalid interval %q", hc.Interval))
+			}
+		}
+
+		if hc.ExpectBodyRegex != "" {
+			if _, err := regexp.Compile(hc.ExpectBodyRegex); err != nil {
+				problems = append(problems, fmt.Errorf("invalid expect_body_regex: %w", err))
+			}
+		}
+
+		for _, code := range hc.ExpectStatus {
+			if code < 100 || code > 599 {
+				problems = append(problems, fmt.Errorf("expect_status %d is not between 100 and 599", code))
+			}
+		}
+
+		if hc.ExpectSHA256 != "" {
+			if sum, err := hex.DecodeString(hc.ExpectSHA256); err != nil || len(sum) != sha256.Size {
+				problems = append(problems, fmt.Errorf("expect_sha256 %q is not a hex encoded SHA-256", hc.ExpectSHA256))
+			}
+		}
+
+		if hc.Body != "" && hc.BodyFile != "" {
+			problems = append(problems, errors.New("body and body_file can't both be set"))
+		} else if hc.BodyFile != "" {
+			if _, err := os.Stat(hc.BodyFilePath()); err != nil {
+				problems = append(problems, fmt.Errorf("invalid body_file: %w", err))
+			}
+		}
+
+		if (hc.ClientCert == "") != (hc.ClientKey == "") {
+			problems = append(problems, errors.New("client_cert and client_key must be set together"))
+		} else if hc.ClientCert != "" {
+			if _, err := hc.LoadClientCert(); err != nil {
+				problems = append(problems, fmt.Errorf("invalid client_cert or client_key: %w", err))
+			}
+		}
+
+		if hc.RequestMethod() == http.MethodHead && hc.checksBody() {
+			problems = append(problems, errors.New("HEAD responses have no body to check against expect_body_contains, expect_body_regex or expect_sha256"))
+		}
+
+		auth := 0
+		for _, set := range []bool{hc.BasicAuth != nil, hc.BearerToken != "", hc.OAuth2 != nil} {
+			if set {
+				auth++
+			}
+		}
+		if auth > 1 {
+			problems = append(problems, errors.New("only one of basic_auth, bearer_token and oauth2 can be set"))
+		}
+
+		if hc.OAuth2 != nil {
+			if address, err := url.Parse(hc.OAuth2.TokenURL); err != nil || (address.Scheme != "http" && address.Scheme != "https") || address.Host == "" {
+				problems = append(problems, fmt.Errorf("oauth2 token_url %q is not a valid HTTP or HTTPS address", hc.OAuth2.TokenURL))
+			}
+			if hc.OAuth2.ClientID == "" {
+				problems = append(problems, errors.New("oauth2 requires a client_id"))
+			}
+		}
+
+		if hc.Retries != nil && *hc.Retries < 0 {
+			problems = append(problems, errors.New("retries must not be negative"))
+		}
+
+		if weight := hc.AggregateWeight(); weight < 0 || math.IsNaN(weight) {
+			problems = append(problems, fmt.Errorf("weight must be a non-negative number, got %g", weight))
+		} else if math.IsInf(weight, 1) {
+			problems = append(problems, errors.New("weight must be finite, got +Inf"))
+		}
+
+		keys := make([]string, 0, len(hc.Labels))
+		for key := range hc.Labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !ValidLabelName(key) {
+				problems = append(problems, fmt.Errorf("label %q is not a valid Prometheus label name", key))
+			} else if reservedLabels[key] {
+				problems = append(problems, fmt.Errorf("label %q is reserved for fetch's own metrics", key))
+			}
+		}
+
+		entries[i] = problems
+	}
+
+	for i, problems := range ValidateDependencies(healthcheck) {
+		entries[i] = append(entries[i], problems...)
+	}
+	return entries
+}
+
+// Check the depends_on of every entry of the config, returning the problems
+// found with each
+func ValidateDependencies(healthcheck []HealthCheck) [][]error {
+	entries := make([][]error, len(healthcheck))
+	dependencies := make(map[string]string)
+	for _, hc := range healthcheck {
+		if _, ok := dependencies[hc.Name]; !ok && hc.Name != "" {
+			dependencies[hc.Name] = hc.DependsOn
+		}
+	}
+	for i, hc := range healthcheck {
+		if hc.DependsOn == "" {
+			continue
+		}
+		if _, ok := dependencies[hc.DependsOn]; !ok {
+			entries[i] = append(entries[i], fmt.Errorf("depends_on %q is not the name of an endpoint", hc.DependsOn))
+		} else if hc.DependsOn == hc.Name {
+			entries[i] = append(entries[i], errors.New("depends_on can't be the endpoint itself"))
+		} else if chain := dependencyCycle(hc.Name, dependencies); chain != nil {
+			entries[i] = append(entries[i], fmt.Errorf("depends_on cycle %s", strings.Join(chain, " -> ")))
+		}
+	}
+	return entries
+}
+
+// The names of the endpoints from name back to itself if following depends_on
+// from it leads back to it, nil otherwise
+func dependencyCycle(name string, dependencies map[string]string) []string {
+	chain := []string{name}
+	seen := map[string]bool{name: true}
+	for next := dependencies[name]; next != ""; next = dependencies[next] {
+		chain = append(chain, next)
+		if next == name {
+			return chain
+		}
+		if seen[next] {
+			return nil // A cycle the endpoint leads into but isn't part of
+		}
+		seen[next] = true
+	}
+	return nil
+}
+
+// Prometheus label names, without the __ prefix reserved for internal use
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Labels of the Prometheus metrics an endpoint's labels can't override
+var reservedLabels = map[string]bool{"name": true, "host": true, "le": true}
+
+// If name can be a key of an endpoint's labels, or what -group-by groups by
+func ValidLabelName(name string) bool {
+	return labelName.MatchString(name) && !strings.HasPrefix(name, "__")
+}
+
+// The standard HTTP methods (RFC 9110 section 9 and RFC 5789), the only ones an
+// endpoint may use unless Options.CustomMethods is set
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodConnect: true,
+}
+
+// An HTTP method must be a non-empty token (RFC 7230 section 3.2.6)
+func validMethod(method string) bool {
+	if method == "" {
+		return false
+	}
+	for _, c := range method {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", c) &&
+			(c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// Options are how every endpoint is checked, unless the endpoint overrides
+// them in its config. Start from DefaultOptions.
+type Options struct {
+	Timeout             time.Duration  // Request timeout, responses slower than this are DOWN
+	Interval            time.Duration  // How often endpoints without an interval are checked
+	LatencyBudget       time.Duration  // Responses slower than this are DOWN even within the timeout, 0 to disable
+	LatencyAlertP95     time.Duration  // p95 latency over which an endpoint is Slow and notified, separately from UP and DOWN, 0 to disable
+	Retries             int            // Times a failed request is retried within the timeout
+	PreferHead          bool           // Check GET endpoints with HEAD, falling back to GET for servers that don't support it
+	AnyResponseUp       bool           // Count any HTTP response as UP whatever its status code
+	DefaultContentType  bool           // Send bodies as Content-Type application/json unless the headers set one
+	AlwaysSendBody      bool           // Send the body with every method rather than only POST, PUT, PATCH and DELETE
+	FollowRedirects     bool           // Follow 3xx redirects rather than checking the redirect itself
+	CustomMethods       bool           // Accept methods other than the standard ones, e.g. for WebDAV or unusual APIs
+	UserAgent           string         // User-Agent header sent unless the endpoint sets one
+	RequestIDHeader     string         // Header a unique ID is sent in with every request, none if empty
+	RequestIDOverride   bool           // Replace the RequestIDHeader even if the endpoint's headers set it
+	HTTPVersion         string         // HTTP version requests are sent over: auto to negotiate it, 1.1 or 2
+	HTTP3               bool           // Send https:// requests over HTTP/3, falling back to TCP for an endpoint once it fails
+	DisableKeepAlives   bool           // Open a new connection for every request rather than reusing them
+	IPVersion           string         // IP version endpoints are connected over: auto for either, 4 or 6
+	Proxy               *url.URL       // Proxy for every request, nil for the proxy environment variables
+	SOCKS5              *url.URL       // SOCKS5 proxy every connection is made through, with an optional username and password, nil for none
+	RootCAs             *x509.CertPool // CA certificates to trust, nil for the system ones
+	Client              ClientFunc     // Wraps or replaces the HTTP client built for each endpoint, e.g. to stub it out, nil to use it as is
+	Concurrency         int            // Maximum number of checks in flight at once, 0 for unlimited
+	Shuffle             bool           // Check the endpoints due at the same time in a new random order every cycle, handing out the Concurrency slots in it
+	Seed                int64          // Seed of the Shuffle, 0 for a random one
+	Jitter              time.Duration  // Maximum random delay of each endpoint's checks after RunOnce, and of its first check after a Reload
+	CycleTimeout        time.Duration  // Deadline of each check including its retries and waiting for a Concurrency slot, 0 for the endpoint's interval
+	Window              int            // Number of most recent attempts uptime is calculated over, 0 for all of them
+	Warmup              time.Duration  // How long after New checks are run but not counted towards the uptime
+	HistorySize         int            // Number of recent successful response times kept for the percentiles
+	MaxBodyBytes        int64          // Maximum number of response body bytes read to check the expected body
+	CountBytes          bool           // Count the body bytes sent and received, reading every response body up to MaxBodyBytes
+	ConsecutiveFailures int            // Failed checks in a row before an endpoint is alerting
+	Criteria            []Criterion    // UP criteria of every response checked after the built-in ones, e.g. a required header
+	Verbose             bool           // Log every request and response to Log
+	Trace               bool           // Log the timing breakdown of every request to Log
+	Log                 io.Writer      // Where warnings and the Verbose and Trace output are written, discarded if nil
+}
+
+// DefaultOptions are the defaults of the fetch command's flags
+func DefaultOptions() Options {
+	return Options{
+		Timeout:             500 * time.Millisecond,
+		Interval:            15 * time.Second,
+		DefaultContentType:  true,
+		FollowRedirects:     true,
+		UserAgent:           "fetch-sre",
+		HTTPVersion:         "auto",
+		IPVersion:           "auto",
+		HistorySize:         1000,
+		MaxBodyBytes:        1 << 20,
+		ConsecutiveFailures: 1,
+	}
+}
+
+// The options must be usable to check endpoints with
+func (o Options) validate() error {
+	switch {
+	case o.Timeout <= 0:
+		return fmt.Errorf("timeout must be greater than zero, got %s", o.Timeout)
+	case o.Interval <= 0:
+		return fmt.Errorf("interval must be greater than zero, got %s", o.Interval)
+	case o.CycleTimeout < 0:
+		return fmt.Errorf("cycle timeout must not be negative, got %s", o.CycleTimeout)
+	case o.MaxBodyBytes <= 0:
+		return fmt.Errorf("max body bytes must be greater than zero, got %d", o.MaxBodyBytes)
+	case o.LatencyAlertP95 < 0:
+		return fmt.Errorf("latency alert p95 must not be negative, got %s", o.LatencyAlertP95)
+	case o.ConsecutiveFailures < 1:
+		return fmt.Errorf("consecutive failures must be at least 1, got %d", o.ConsecutiveFailures)
+	case o.HTTPVersion != "auto" && o.HTTPVersion != "1.1" && o.HTTPVersion != "2":
+		return fmt.Errorf("HTTP version must be auto, 1.1 or 2, got %q", o.HTTPVersion)
+	case o.IPVersion != "auto" && o.IPVersion != "4" && o.IPVersion != "6":
+		return fmt.Errorf("IP version must be auto, 4 or 6, got %q", o.IPVersion)
+	case o.HTTP3 && o.HTTPVersion != "auto":
+		return fmt.Errorf("HTTP/3 can't be used with HTTP version %s", o.HTTPVersion)
+	case o.HTTP3 && (o.Proxy != nil || o.SOCKS5 != nil):
+		return errors.New("HTTP/3 can't be sent through a proxy")
+	case o.HTTP3 && o.DisableKeepAlives:
+		return errors.New("HTTP/3 can't be used with keep-alives disabled")
+	}
+	for i, criterion := range o.Criteria {
+		if criterion.Name == "" || criterion.Check == nil {
+			return fmt.Errorf("criterion %d must have a name and a check", i+1)
+		}
+	}
+	return nil
+}
+
+// Restrict a network such as tcp or ip to the IPVersion, e.g. tcp4
+func (o Options) IPNetwork(network string) string {
+	if o.IPVersion == "auto" || o.IPVersion == "" {
+		return network
+	}
+	return strings.TrimRight(network, "46") + o.IPVersion
+}
+
+// Connect to the address through the SOCKS5 proxy if one is set, or else
+// directly over the IPVersion
+func (o Options) dialContext(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	if o.SOCKS5 != nil {
+		return dialSOCKS5(ctx, dialer, o.SOCKS5, addr)
+	}
+	return dialer.DialContext(ctx, o.IPNetwork(network), addr)
+}
+
+// Write a warning or the Verbose and Trace output to Log
+func (o Options) logf(format string, args ...any) {
+	if o.Log != nil {
+		fmt.Fprintf(o.Log, format, args...)
+	}
+}
+
+// Delay before the first retry of a failed request, doubled on every retry
+var retryBackoff time.Duration = 50 * time.Millisecond
+
+// Upper bounds in seconds of the response time buckets of every Result, e.g.
+// for a Prometheus histogram
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Result is the data structure to store the history of attempts
+type Result struct {
+	Host          string            // Hostname of the endpoint's URL
+	Up            bool              // Outcome of the most recent attempt
+	Error         string            // Reason the most recent attempt was DOWN
+	Status        int               // HTTP status code of the most recent attempt, 0 if there was no response
+	Criterion     string            // UP criterion the most recent attempt failed, see CheckResult.Criterion
+	Checked       time.Time         // When the most recent attempt finished
+	LastSuccess   time.Time         // When the most recent successful attempt finished, zero if there was none
+	Disabled      bool              // Not checked, see HealthCheck.IsEnabled
+	DependsOn     string            // HealthCheck.DependsOn
+	Skipped       bool              // The most recent check was skipped as the DependsOn endpoint wasn't UP
+	Weight        float64           // Weight in the aggregate uptime, see HealthCheck.AggregateWeight
+	Labels        map[string]string // HealthCheck.Labels
+	Failures      map[string]int    // DOWN attempts per errorCategory
+	Consecutive   int               // Failed attempts since the last successful one
+	Attempt       float64
+	Success       float64
+	Latency       time.Duration       // Total response time of successful attempts
+	BytesSent     int64               // Total request body bytes, see Options.CountBytes
+	BytesReceived int64               // Total response body bytes read, see Options.CountBytes
+	recent        ring[bool]          // Outcome of the last Options.Window attempts
+	buckets       []uint64            // Successful attempts per LatencyBuckets upper bound
+	samples       ring[time.Duration] // The last Options.HistorySize successful response times
+	alertAfter    int                 // Options.ConsecutiveFailures
+	slowAbove     time.Duration       // Options.LatencyAlertP95
+}
+
+// Create the empty history of an endpoint, with its buffers sized by its
+// Options.Window and Options.HistorySize
+func newResult(hc HealthCheck) *Result {
+	return &Result{
+		Host:       hc.hostname,
+		Disabled:   !hc.IsEnabled(),
+		Weight:     hc.AggregateWeight(),
+		Labels:     hc.Labels,
+		DependsOn:  hc.DependsOn,
+		recent:     newRing[bool](hc.opts.Window),
+		samples:    newRing[time.Duration](hc.opts.HistorySize),
+		alertAfter: hc.opts.ConsecutiveFailures,
+		slowAbove:  hc.opts.LatencyAlertP95,
+	}
+}
+
+// ring is a fixed size buffer of the most recent values pushed to it, which
+// overwrites the oldest value once full so memory stays bounded
+type ring[T any] struct {
+	values []T
+	next   int // Index in values the next value is written to once full
+	size   int
+}
+
+// Create a ring buffer of up to size values, one of size 0 keeps nothing
+func newRing[T any](size int) ring[T] {
+	return ring[T]{size: size}
+}
+
+// Add a value, overwriting the oldest one if the buffer is full
+func (r *ring[T]) push(value T) {
+	if r.size <= 0 {
+		return
+	}
+	if len(r.values) < r.size {
+		r.values = append(r.values, value)
+	} else {
+		r.values[r.next] = value
+	}
+	r.next = (r.next + 1) % r.size
+}
+
+// Replace the contents with values, oldest first, keeping only the newest that fit
+func (r *ring[T]) load(values []T) {
+	r.values, r.next = nil, 0
+	for _, value := range values {
+		r.push(value)
+	}
+}
+
+// Number of values in the buffer
+func (r ring[T]) len() int {
+	return len(r.values)
+}
+
+// Copy of the values in the buffer, oldest first
+func (r ring[T]) items() []T {
+	items := make([]T, 0, len(r.values))
+	items = append(items, r.values[r.next:]...)
+	return append(items, r.values[:r.next]...)
+}
+
+// Record the outcome of a single attempt, returning if the endpoint started or
+// stopped alerting and if it started or stopped being Slow. Endpoints are
+// assumed to be UP and not slow before the first attempt.
+func (r *Result) record(res CheckResult) (changed, slowChanged bool) {
+	wasAlerting, wasSlow := r.Alerting(), r.Slow()
+	if res.Up {
+		r.Consecutive = 0
+	} else {
+		r.Consecutive++
+	}
+	changed = r.Alerting() != wasAlerting
+
+	r.observe(res)
+	r.Attempt++
+	r.BytesSent += res.BytesSent
+	r.BytesReceived += res.BytesReceived
+	if !res.Up {
+		if r.Failures == nil {
+			r.Failures = make(map[string]int)
+		}
+		r.Failures[res.Category]++
+	}
+	if res.Up {
+		r.Success++
+		r.Latency += res.Latency
+
+		if r.buckets == nil {
+			r.buckets = make([]uint64, len(LatencyBuckets))
+		}
+		for i, bound := range LatencyBuckets {
+			if res.Latency.Seconds() <= bound {
+				r.buckets[i]++
+			}
+		}
+		r.samples.push(res.Latency)
+	}
+
+	// Attempts that fall outside of the rolling window are overwritten
+	r.recent.push(res.Up)
+	return changed, r.Slow() != wasSlow
+}
+
+// Update the state of the endpoint to the outcome of an attempt, without
+// counting it towards the uptime
+func (r *Result) observe(res CheckResult) {
+	r.Skipped = false
+	r.Up = res.Up
+	r.Status = res.StatusCode
+	r.Criterion = res.Criterion
+	r.Checked = time.Now()
+	if res.Up {
+		r.LastSuccess = r.Checked
+	}
+	r.Error = ""
+	if res.Err != nil {
+		r.Error = res.Err.Error()
+	}
+}
+
+// If the endpoints that depend on this one are skipped: it's DOWN, or skipped
+// itself, and enabled
+func (r Result) blocksDependents() bool {
+	return !r.Disabled && (r.Skipped || !r.Checked.IsZero() && !r.Up)
+}
+
+// If the p95 latency of the endpoint's recent successful attempts is over
+// Options.LatencyAlertP95, so it's notified as SLOW and highlighted in the output
+func (r Result) Slow() bool {
+	return r.slowAbove > 0 && r.Percentile(95) > r.slowAbove
+}
+
+// If the endpoint has failed Options.ConsecutiveFailures checks in a row, so
+// it's notified as DOWN and highlighted in the output
+func (r Result) Alerting() bool {
+	return r.Consecutive >= r.alertAfter
+}
+
+// CheckResult is the outcome of a single HTTP request to an endpoint
+type CheckResult struct {
+	Up         bool
+	StatusCode int           // 0 if no response was received
+	Latency    time.Duration // Round-trip time of the request
+	Err        error         // Reason the endpoint is DOWN, nil if UP
+	Criterion  string        // Name of the UP criterion the response failed, empty if UP or there was no response
+	Category   string        // Kind of failure, see errorCategory, empty if UP
+
+	// Request and response body bytes of every try of the check, counted with
+	// Options.CountBytes
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// Categorize why a check was DOWN: the UP criterion the response failed, or
+// for requests without a response oauth2, timeout, connection_refused, dns, tls
+// or other
+func errorCategory(res CheckResult) string {
+	if res.Up {
+		return ""
+	}
+	if res.Criterion != "" {
+		return res.Criterion
+	}
+
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch err := res.Err; {
+	case errors.Is(err, errToken):
+		return "oauth2"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &verifyErr),
+		errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return "tls"
+	}
+	return "other"
+}
+
+// Calculate successful percentage of uptime for an endpoint,
+// over the rolling window if one is configured
+func (r Result) Uptime() int {
+	return int(math.Round(100 * r.UptimeRatio()))
+}
+
+// Calculate successful percentage of uptime for an endpoint rounded to decimals
+// places, e.g. 99.95 rather than Uptime's 100 with 2, over the rolling window
+// if one is configured
+func (r Result) UptimePercent(decimals int) float64 {
+	return Percent(r.UptimeRatio(), decimals)
+}
+
+// Convert a ratio (0 to 1) to a percentage rounded to decimals places
+func Percent(ratio float64, decimals int) float64 {
+	scale := math.Pow10(decimals)
+	return math.Round(100*ratio*scale) / scale
+}
+
+// Calculate the ratio (0 to 1) of successful attempts for an endpoint,
+// over the rolling window if one is configured
+func (r Result) UptimeRatio() float64 {
+	success, attempt := r.Counts()
+	if attempt == 0 {
+		return 0
+	}
+	return success / attempt
+}
+
+// Number of successful and total attempts uptime is calculated over, within
+// the rolling window if one is configured
+func (r Result) Counts() (success, attempt float64) {
+	if r.recent.size > 0 {
+		for _, up := range r.recent.values {
+			if up {
+				success++
+			}
+		}
+		return success, float64(r.recent.len())
+	}
+	return r.Success, r.Attempt
+}
+
+// Calculate the average response time of successful attempts
+func (r Result) AvgLatency() time.Duration {
+	if r.Success == 0 {
+		return 0
+	}
+	return time.Duration(float64(r.Latency) / r.Success)
+}
+
+// Calculate the p-th percentile (0 to 100) of recent successful response times
+func (r Result) Percentile(p float64) time.Duration {
+	if r.samples.len() == 0 {
+		return 0
+	}
+
+	sorted := r.samples.items()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	// Nearest-rank method
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Number of successful attempts at or below each of the LatencyBuckets
+func (r Result) Buckets() []uint64 {
+	buckets := make([]uint64, len(LatencyBuckets))
+	copy(buckets, r.buckets)
+	return buckets
+}
+
+// SavedResult is the history of an endpoint, e.g. to persist it across runs
+type SavedResult struct {
+	Up          bool            `json:"up"`
+	Status      int             `json:"status,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Attempt     float64         `json:"attempt"`
+	Success     float64         `json:"success"`
+	Latency     time.Duration   `json:"latency"`
+	Recent      []bool          `json:"recent,omitempty"`
+	Buckets     []uint64        `json:"buckets,omitempty"`
+	Samples     []time.Duration `json:"samples,omitempty"` // Oldest first
+	Failures    map[string]int  `json:"failures,omitempty"`
+	Consecutive int             `json:"consecutive,omitempty"`
+	LastSuccess time.Time       `json:"last_success,omitzero"`
+
+	BytesSent     int64 `json:"bytes_sent,omitempty"`
+	BytesReceived int64 `json:"bytes_received,omitempty"`
+}
+
+// Save the history of the endpoint
+func (r Result) Save() SavedResult {
+	return SavedResult{
+		Up:          r.Up,
+		Status:      r.Status,
+		Error:       r.Error,
+		Attempt:     r.Attempt,
+		Success:     r.Success,
+		Latency:     r.Latency,
+		Recent:      r.recent.items(),
+		Buckets:     r.buckets,
+		Samples:     r.samples.items(),
+		Failures:    r.Failures,
+		Consecutive: r.Consecutive,
+		LastSuccess: r.LastSuccess,
+
+		BytesSent:     r.BytesSent,
+		BytesReceived: r.BytesReceived,
+	}
+}
+
+// Restore a saved history of the endpoint, keeping only as many recent
+// attempts and response times as its buffers hold
+func (r *Result) Restore(s SavedResult) {
+	r.Up = s.Up
+	r.Status = s.Status
+	r.Error = s.Error
+	r.Attempt = s.Attempt
+	r.Success = s.Success
+	r.Latency = s.Latency
+	if len(s.Buckets) == len(LatencyBuckets) {
+		r.buckets = s.Buckets
+	}
+	r.recent.load(s.Recent)
+	r.samples.load(s.Samples)
+	r.Failures = s.Failures
+	r.Consecutive = s.Consecutive
+	r.LastSuccess = s.LastSuccess
+	r.BytesSent = s.BytesSent
+	r.BytesReceived = s.BytesReceived
+}
+
+// Thread-safe structure for tracking percent uptime of endpoints, keyed by
+// name. Sites must only be used with the lock held.
+type Results struct {
+	lock  sync.Mutex
+	Sites map[string]*Result
+}
+
+// Lock the results, while they're read or updated
+func (s *Results) Lock() {
+	s.lock.Lock()
+}
+
+// Unlock the results
+func (s *Results) Unlock() {
+	s.lock.Unlock()
+}
+
+// Transition is the notification sent when an endpoint changes between UP and
+// DOWN, or with Options.LatencyAlertP95 between SLOW and FAST
+type Transition struct {
+	Name      string    `json:"name"`
+	Host      string    `json:"host"`
+	State     string    `json:"state"`
+	Timestamp time.Time `json:"timestamp"`
+	Error     string    `json:"error,omitempty"`
+	Uptime    int       `json:"uptime"`
+
+	// p95 latency in milliseconds of the SLOW and FAST transitions
+	P95LatencyMs float64 `json:"p95_latency_ms,omitempty"`
+}
+
+// The transition of an endpoint whose p95 latency crossed Options.LatencyAlertP95
+func newLatencyTransition(hc HealthCheck, slow bool, p95 time.Duration, uptime int) Transition {
+	t := Transition{
+		Name:         hc.Name,
+		Host:         hc.hostname,
+		State:        "FAST",
+		Timestamp:    time.Now(),
+		Uptime:       uptime,
+		P95LatencyMs: float64(p95) / float64(time.Millisecond),
+	}
+	if slow {
+		t.State = "SLOW"
+		t.Error = fmt.Sprintf("p95 latency of %s is over %s", p95.Round(time.Millisecond), hc.opts.LatencyAlertP95)
+	}
+	return t
+}
+
+func newTransition(hc HealthCheck, res CheckResult, uptime int) Transition {
+	t := Transition{
+		Name:      hc.Name,
+		Host:      hc.hostname,
+		State:     "DOWN",
+		Timestamp: time.Now(),
+		Uptime:    uptime,
+	}
+	if res.Up {
+		t.State = "UP"
+	}
+	if res.Err != nil {
+		t.Error = res.Err.Error()
+	}
+	return t
+}
+
+// Monitor checks a set of endpoints and records the outcomes in its Results
+type Monitor struct {
+	// OnResult, if set, is called with every check once it's recorded. It's
+	// called from the goroutine that ran the check, so it must be safe to call
+	// concurrently.
+	OnResult func(site HealthCheck, res CheckResult)
+
+	// OnTransition, if set, is called when an endpoint starts or stops
+	// alerting, see Options.ConsecutiveFailures, or being Slow. It's called
+	// like OnResult.
+	OnTransition func(t Transition)
+
+	opts      Options
+	results   *Results
+	semaphore chan struct{} // Limits the checks in flight, nil if unlimited
+	created   time.Time     // When New was called, the start of the Warmup
+
+	shuffleLock sync.Mutex     // Guards shuffle
+	shuffle     *mathrand.Rand // Draws the order of every cycle, nil unless Options.Shuffle
+
+	lock      sync.Mutex // Guards endpoints, running and retired
+	endpoints []HealthCheck
+	running   *monitors   // Started by Start, nil if stopped
+	retired   []*monitors // Replaced by Reload, finishing their checks in flight
+}
+
+// monitors are the goroutines checking each endpoint on its own interval
+type monitors struct {
+	ctx    context.Context    // Context they were started with, to restart them on Reload
+	checks context.Context    // Context of the checks, done once cancelled
+	loops  context.Context    // Done once retired or cancelled, so no more checks are started
+	cancel context.CancelFunc // Cancels the checks in flight as well
+	retire context.CancelFunc // Stops starting checks, letting those in flight finish
+	wg     *sync.WaitGroup
+}
+
+// New validates the endpoints, prepares them to be checked with opts and
+// returns a Monitor of them with an empty history
+func New(endpoints []HealthCheck, opts Options) (*Monitor, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if err := Validate(endpoints, opts.CustomMethods); err != nil {
+		return nil, err
+	}
+
+	// Every cycle's order is drawn from the seed, so a run can be reproduced
+	if opts.Shuffle && opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+	if opts.Shuffle && opts.Verbose {
+		opts.logf("Shuffling the checks with -seed %d\n", opts.Seed)
+	}
+
+	m := &Monitor{
+		opts:    opts,
+		results: &Results{Sites: make(map[string]*Result)},
+		created: time.Now(),
+	}
+	if opts.Concurrency > 0 {
+		m.semaphore = make(chan struct{}, opts.Concurrency)
+	}
+	if opts.Shuffle {
+		m.shuffle = mathrand.New(mathrand.NewSource(opts.Seed))
+	}
+	m.endpoints = m.prepare(endpoints)
+	for _, hc := range m.endpoints {
+		m.results.Sites[hc.Name] = newResult(hc)
+	}
+	return m, nil
+}
+
+// The history of every endpoint
+func (m *Monitor) Results() *Results {
+	return m.results
+}
+
+// The endpoints being checked, as prepared by New or Reload
+func (m *Monitor) Endpoints() []HealthCheck {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]HealthCheck(nil), m.endpoints...)
+}
+
+// Fill in the parsed fields of a copy of validated endpoints
+func (m *Monitor) prepare(endpoints []HealthCheck) []HealthCheck {
+	healthcheck := append([]HealthCheck(nil), endpoints...)
+	for i, hc := range healthcheck {
+		healthcheck[i].opts = &m.opts
+		hc.opts = &m.opts
+
+		if (hc.Body != "" || hc.BodyFile != "") && !hc.sendsBody() {
+			m.opts.logf("Warning: %s has a body but it won't be sent with %s, see -always-send-body\n", hc.Name, hc.RequestMethod())
+		}
+
+		if hc.ClientCert != "" {
+			cert, err := hc.LoadClientCert()
+			if err != nil {
+				m.opts.logf("Warning: Unable to load the client certificate of %s: %s\n", hc.Name, err)
+			} else {
+				healthcheck[i].clientCert = &cert
+			}
+		}
+
+		healthcheck[i].transport = newTransport(healthcheck[i])
+		if m.opts.HTTP3 {
+			healthcheck[i].http3 = newHTTP3Transport(healthcheck[i])
+		}
+
+		// Get the subdomain.domain.whatever
+		// e.g.: http://www.foo.com -> www.foo.com
+		rawURL, _ := hc.ExampleURL()
+		address, _ := url.Parse(rawURL)
+		healthcheck[i].hostname = address.Hostname()
+		healthcheck[i].urlTemplate, _ = hc.parseURLTemplate()
+		healthcheck[i].checks = new(atomic.Uint64)
+		healthcheck[i].noHead = new(atomic.Bool)
+
+		if hc.ExpectBodyRegex != "" {
+			healthcheck[i].bodyRegex = regexp.MustCompile(hc.ExpectBodyRegex)
+		}
+
+		// Per-endpoint timeout and interval overrides
+		if hc.Timeout != "" {
+			healthcheck[i].timeout, _ = time.ParseDuration(hc.Timeout)
+		}
+		if hc.Interval != "" {
+			healthcheck[i].interval, _ = time.ParseDuration(hc.Interval)
+		}
+		if timeout, cycle := healthcheck[i].requestTimeout(), healthcheck[i].cycleTimeout(); timeout > cycle {
+			m.opts.logf("Warning: %s has a timeout of %s, but its checks are cancelled after the cycle timeout of %s\n", hc.Name, timeout, cycle)
+		}
+
+		client := newClient(healthcheck[i])
+		healthcheck[i].client = client
+		if m.opts.Client != nil {
+			healthcheck[i].client = m.opts.Client(healthcheck[i], client)
+		}
+		if hc.OAuth2 != nil {
+			healthcheck[i].tokens = newTokenSource(healthcheck[i])
+		}
+	}
+	return healthcheck
+}
+
+// Reload replaces the endpoints, keeping the history of those that are still
+// configured, and returns the names of the ones added and removed. If the
+// Monitor was started it's restarted, checking every endpoint right away, or
+// within Options.Jitter. The checks in flight aren't waited for: they finish
+// in the background, and the outcomes of removed endpoints are dropped. On
+// error the current endpoints are kept.
+func (m *Monitor) Reload(endpoints []HealthCheck) (added, removed []string, err error) {
+	if err := Validate(endpoints, m.opts.CustomMethods); err != nil {
+		return nil, nil, err
+	}
+	healthcheck := m.prepare(endpoints)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// The endpoints are swapped along with their results, so a check
+	// finishing in between is recorded for the endpoints it was started for
+	configured := make(map[string]bool)
+	m.results.Lock()
+	for _, hc := range healthcheck {
+		configured[hc.Name] = true
+		if res, ok := m.results.Sites[hc.Name]; ok {
+			res.Host = hc.hostname
+			res.Disabled = !hc.IsEnabled()
+			res.Weight = hc.AggregateWeight()
+			res.Labels = hc.Labels
+			res.DependsOn = hc.DependsOn
+			continue
+		}
+		m.results.Sites[hc.Name] = newResult(hc)
+		added = append(added, hc.Name)
+	}
+	for name := range m.results.Sites {
+		if !configured[name] {
+			delete(m.results.Sites, name)
+			removed = append(removed, name)
+		}
+	}
+	replaced := m.endpoints
+	m.endpoints = healthcheck
+	m.results.Unlock()
+
+	if m.running == nil {
+		release(replaced)
+	} else {
+		old := m.running
+		old.retire()
+		m.retired = append(m.retired, old)
+		m.running = m.start(old.ctx, true)
+
+		// Once its checks are done, the replaced transports can be released
+		go func() {
+			old.wg.Wait()
+			old.cancel()
+			release(replaced)
+
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			for i, monitors := range m.retired {
+				if monitors == old {
+					m.retired = append(m.retired[:i], m.retired[i+1:]...)
+					break
+				}
+			}
+		}()
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed, nil
+}
+
+// Run checks every endpoint right away and then each on its own interval,
+// until ctx is done
+func (m *Monitor) Run(ctx context.Context) error {
+	m.RunOnce(ctx)
+	m.Start(ctx)
+	<-ctx.Done()
+	m.Stop()
+	return ctx.Err()
+}
+
+// RunOnce checks every endpoint once, returning when all of the checks are
+// done. Endpoints are checked after the one they depend on, so they're skipped
+// if it's DOWN in this cycle.
+func (m *Monitor) RunOnce(ctx context.Context) {
+	var endpoints []HealthCheck
+	done := make(map[string]chan struct{}) // Closed once the endpoint was checked
+	for _, hc := range m.order(m.Endpoints()) {
+		if hc.IsEnabled() {
+			endpoints = append(endpoints, hc)
+			done[hc.Name] = make(chan struct{})
+		}
+	}
+
+	// Endpoints waiting for their dependency are checked as soon as it's
+	// done, so they don't take a turn
+	independent := 0
+	for _, hc := range endpoints {
+		if _, ok := done[hc.DependsOn]; !ok {
+			independent++
+		}
+	}
+	turns := m.turns(independent)
+
+	wg := new(sync.WaitGroup)
+	for _, hc := range endpoints {
+		dependency, ok := done[hc.DependsOn]
+		var turn *turn
+		if !ok {
+			turn, turns = turns[0], turns[1:]
+		}
+
+		wg.Add(1)
+		go func(hc HealthCheck) {
+			defer wg.Done()
+			defer close(done[hc.Name])
+
+			// Dependencies are validated not to form a cycle, so this ends
+			if ok {
+				select {
+				case <-ctx.Done():
+					return
+				case <-dependency:
+				}
+			}
+			m.runCheck(ctx, hc, turn)
+		}(hc)
+	}
+	wg.Wait()
+}
+
+// Start checking each endpoint on its own interval in the background, the
+// first time one interval from now, until ctx is done or Stop is called
+func (m *Monitor) Start(ctx context.Context) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.stop()
+	m.running = m.start(ctx, false)
+}
+
+// Stop checking the endpoints, waiting for in-flight checks to be cancelled
+func (m *Monitor) Stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.stop()
+}
+
+// Release the idle connections of the transports of endpoints no longer checked
+func release(endpoints []HealthCheck) {
+	for _, hc := range endpoints {
+		hc.transport.CloseIdleConnections()
+		if hc.http3 != nil {
+			hc.http3.close()
+		}
+	}
+}
+
+// Start a goroutine per endpoint checking it on its interval, or
+// Options.Interval if it has none. If checkFirst is set the endpoints are also
+// checked right away. The lock must be held.
+func (m *Monitor) start(ctx context.Context, checkFirst bool) *monitors {
+	running := &monitors{ctx: ctx, wg: new(sync.WaitGroup)}
+	running.checks, running.cancel = context.WithCancel(ctx)
+	running.loops, running.retire = context.WithCancel(running.checks)
+	checks, loops := running.checks, running.loops
+
+	// With a Jitter the endpoints aren't due at the same time, so there's no
+	// order to shuffle after RunOnce
+	if m.opts.Shuffle && m.opts.Jitter == 0 {
+		for _, group := range groupByInterval(m.endpoints) {
+			running.wg.Add(1)
+			go m.runShuffled(running, group, checkFirst)
+		}
+		return running
+	}
+
+	for _, hc := range m.endpoints {
+		if !hc.IsEnabled() {
+			continue
+		}
+		running.wg.Add(1)
+		go func(hc HealthCheck) {
+			defer running.wg.Done()
+
+			interval := hc.checkInterval()
+
+			// Stagger the endpoints so they aren't all checked at once, also
+			// their first check after a Reload
+			if m.opts.Jitter > 0 {
+				spread := m.opts.Jitter
+				if spread > interval {
+					spread = interval
+				}
+				select {
+				case <-loops.Done():
+					return
+				case <-time.After(time.Duration(mathrand.Int63n(int64(spread)))):
+				}
+			}
+
+			if checkFirst {
+				m.runCheck(checks, hc, nil)
+			}
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-loops.Done():
+					return
+				case <-ticker.C:
+					m.runCheck(checks, hc, nil)
+				}
+			}
+		}(hc)
+	}
+	return running
+}
+
+// The enabled endpoints grouped by their interval, in the order of the first
+// endpoint of each group
+func groupByInterval(endpoints []HealthCheck) [][]HealthCheck {
+	var groups [][]HealthCheck
+	index := make(map[time.Duration]int)
+	for _, hc := range endpoints {
+		if !hc.IsEnabled() {
+			continue
+		}
+		interval := hc.checkInterval()
+		if i, ok := index[interval]; ok {
+			groups[i] = append(groups[i], hc)
+			continue
+		}
+		index[interval] = len(groups)
+		groups = append(groups, []HealthCheck{hc})
+	}
+	return groups
+}
+
+// Check endpoints sharing an interval every interval in a new random order,
+// for Options.Shuffle, until the monitors are retired. An endpoint whose check
+// from the previous cycle is still running sits the cycle out, like a ticker
+// dropping a tick. The checks are added to the monitors' wg, which is done
+// once the cycles stop.
+func (m *Monitor) runShuffled(running *monitors, group []HealthCheck, checkFirst bool) {
+	wg := running.wg
+	defer wg.Done()
+
+	busy := make(map[string]*atomic.Bool)
+	for _, hc := range group {
+		busy[hc.Name] = new(atomic.Bool)
+	}
+	cycle := func() {
+		var due []HealthCheck
+		for _, hc := range m.order(group) {
+			if !busy[hc.Name].Load() {
+				due = append(due, hc)
+			}
+		}
+		for i, turn := range m.turns(len(due)) {
+			hc := due[i]
+			busy[hc.Name].Store(true)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer busy[hc.Name].Store(false)
+				m.runCheck(running.checks, hc, turn)
+			}()
+		}
+	}
+
+	if checkFirst {
+		cycle()
+	}
+	ticker := time.NewTicker(group[0].checkInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-running.loops.Done():
+			return
+		case <-ticker.C:
+			cycle()
+		}
+	}
+}
+
+// The endpoints in the order to check them in this cycle, a new random one
+// every cycle with Options.Shuffle
+func (m *Monitor) order(endpoints []HealthCheck) []HealthCheck {
+	if m.shuffle == nil {
+		return endpoints
+	}
+	shuffled := append([]HealthCheck(nil), endpoints...)
+	m.shuffleLock.Lock()
+	defer m.shuffleLock.Unlock()
+	m.shuffle.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
+
+// turn of a check of a cycle to queue for a Concurrency slot, so that the
+// slots are handed out in the order of the cycle
+type turn struct {
+	wait   <-chan struct{} // Closed once the check before it got a slot or gave up
+	next   chan struct{}   // Closed once this check did, see pass
+	passed sync.Once
+}
+
+// Turns of n checks to queue for a Concurrency slot one after the other, all
+// nil unless the slots are limited and the order is shuffled, as otherwise it
+// doesn't matter which check gets a slot first
+func (m *Monitor) turns(n int) []*turn {
+	turns := make([]*turn, n)
+	if m.shuffle == nil || m.semaphore == nil {
+		return turns
+	}
+	wait := make(chan struct{})
+	close(wait)
+	for i := range turns {
+		turns[i] = &turn{wait: wait, next: make(chan struct{})}
+		wait = turns[i].next
+	}
+	return turns
+}
+
+// Wait for the check before to get a slot or give up, or for ctx to be done
+func (t *turn) await(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	select {
+	case <-t.wait:
+	case <-ctx.Done():
+	}
+}
+
+// Let the next check queue for a slot, once this one got one or gave up
+func (t *turn) pass() {
+	if t != nil {
+		t.passed.Do(func() { close(t.next) })
+	}
+}
+
+// Stop the running monitors, if any, and the checks in flight of those
+// retired by Reload. The lock must be held.
+func (m *Monitor) stop() {
+	for _, monitors := range append(m.retired, m.running) {
+		if monitors != nil {
+			monitors.cancel()
+			monitors.wg.Wait()
+		}
+	}
+	m.running, m.retired = nil, nil
+}
+
+// Check an endpoint and record the outcome in the results, queueing for a
+// Concurrency slot on its turn, nil to queue right away
+func (m *Monitor) runCheck(ctx context.Context, hc HealthCheck, turn *turn) {
+	defer turn.pass()
+	if m.skip(hc) {
+		return
+	}
+
+	// Stragglers are cancelled at the cycle timeout and count as DOWN, so a
+	// hanging endpoint can't hold up the schedule
+	cycle := hc.cycleTimeout()
+	checkCtx, cancel := context.WithTimeout(ctx, cycle)
+	defer cancel()
+
+	var res CheckResult
+	acquired := m.semaphore == nil
+	if !acquired {
+		turn.await(checkCtx)
+		select {
+		case m.semaphore <- struct{}{}:
+			defer func() { <-m.semaphore }()
+			acquired = true
+		case <-checkCtx.Done():
+		}
+		turn.pass()
+	}
+	if acquired {
+		res = Check(checkCtx, hc)
+	}
+
+	// Requests aborted by shutdown don't count as an attempt
+	if ctx.Err() != nil {
+		return
+	}
+	if !acquired {
+		res = CheckResult{Err: fmt.Errorf("cycle timeout of %s exceeded waiting for a concurrency slot", cycle), Category: "timeout"}
+	} else if !res.Up && checkCtx.Err() != nil {
+		res.Err = fmt.Errorf("cycle timeout of %s exceeded: %w", cycle, res.Err)
+	}
+
+	// Checks during the warmup only update the endpoint's state, so a cold
+	// start doesn't count against its uptime
+	warming := time.Since(m.created) < m.opts.Warmup
+
+	// The endpoint may have been removed by a Reload while it was checked
+	var changed, slowChanged, slow bool
+	var uptime int
+	var p95 time.Duration
+	m.results.Lock()
+	site, ok := m.results.Sites[hc.Name]
+	if ok {
+		if warming {
+			site.observe(res)
+		} else {
+			changed, slowChanged = site.record(res)
+		}
+		uptime = site.Uptime()
+		slow, p95 = site.Slow(), site.Percentile(95)
+	}
+	m.results.Unlock()
+	if !ok {
+		return
+	}
+
+	if m.OnResult != nil {
+		m.OnResult(hc, res)
+	}
+	if changed && m.OnTransition != nil {
+		m.OnTransition(newTransition(hc, res, uptime))
+	}
+	if slowChanged && m.OnTransition != nil {
+		m.OnTransition(newLatencyTransition(hc, slow, p95, uptime))
+	}
+}
+
+// Mark the endpoint as Skipped rather than checking it if the endpoint it
+// depends on is DOWN or skipped, returning if it was. Skips aren't recorded as
+// an attempt, so they have no OnResult or OnTransition.
+func (m *Monitor) skip(hc HealthCheck) bool {
+	if hc.DependsOn == "" {
+		return false
+	}
+
+	m.results.Lock()
+	defer m.results.Unlock()
+	site, ok := m.results.Sites[hc.Name]
+	dependency, found := m.results.Sites[hc.DependsOn]
+	if !ok || !found || !dependency.blocksDependents() {
+		return false
+	}
+	site.Skipped = true
+	return true
+}
+
+// Build the HTTP transport used for every request to the endpoint
+func newTransport(site HealthCheck) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY are honored unless a Proxy is set,
+	// and no HTTP proxy is used when connecting through a SOCKS5 one
+	transport.Proxy = http.ProxyFromEnvironment
+	if site.opts.Proxy != nil {
+		transport.Proxy = http.ProxyURL(site.opts.Proxy)
+	} else if site.opts.SOCKS5 != nil {
+		transport.Proxy = nil
+	}
+
+	// Connect over the SOCKS5 proxy or the IPVersion, with the default dialer settings
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return site.opts.dialContext(ctx, dialer, network, addr)
+	}
+
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:            site.opts.RootCAs,
+		InsecureSkipVerify: site.InsecureSkipVerify,
+	}
+	if site.clientCert != nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*site.clientCert}
+	}
+
+	// Pin the HTTPVersion. A non-nil empty TLSNextProto disables HTTP/2, and
+	// responses that didn't use HTTP/2 when it's required fail checkProtocol
+	switch site.opts.HTTPVersion {
+	case "1.1":
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	case "2":
+		transport.ForceAttemptHTTP2 = true
+
+		// There's no TLS to negotiate HTTP/2 over for http:// endpoints, so
+		// they're sent over unencrypted HTTP/2 with prior knowledge
+		rawURL, _ := site.ExampleURL()
+		if address, err := url.Parse(rawURL); err == nil && address.Scheme == "http" {
+			transport.Protocols = new(http.Protocols)
+			transport.Protocols.SetHTTP2(true)
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		}
+	}
+
+	// Every check then pays for the TCP and TLS handshakes, see -trace
+	transport.DisableKeepAlives = site.opts.DisableKeepAlives
+	return transport
+}
+
+// Messages of the SOCKS5 reply codes, see RFC 1928 section 6
+var socks5Replies = []string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Connect to the address through the SOCKS5 proxy (RFC 1928), authenticating
+// with its username and password (RFC 1929) if it has them. Hostnames are
+// resolved by the proxy, so endpoints only it can resolve are reachable.
+func dialSOCKS5(ctx context.Context, dialer *net.Dialer, proxy *url.URL, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake shares the deadline of the check
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := socks5Connect(conn, proxy.User, addr); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 proxy %s: %w", proxy.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Negotiate a connection to the address with a SOCKS5 proxy
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) error {
+	host, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port %q", portText)
+	}
+
+	// Offer no authentication, or only username and password if they're set
+	method := byte(0x00)
+	if user != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return errors.New("not a SOCKS5 proxy")
+	}
+	if reply[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+
+	if user != nil {
+		username := user.Username()
+		password, _ := user.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("username and password must be at most 255 bytes")
+		}
+		auth := append([]byte{1, byte(len(username))}, username...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("username and password rejected")
+		}
+	}
+
+	// CONNECT to an IP address or else the hostname
+	request := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("hostname %q is longer than 255 bytes", host)
+		}
+		request = append(append(request, 3, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(append(request, 1), ip4...)
+	} else {
+		request = append(append(request, 4), ip.To16()...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// The reply is the version, status, a reserved byte and the bound address
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		message := fmt.Sprintf("reply code %d", header[1])
+		if int(header[1]) < len(socks5Replies) {
+			message = socks5Replies[header[1]]
+		}
+		return fmt.Errorf("unable to connect to %s: %s", addr, message)
+	}
+	var length int
+	switch header[3] {
+	case 1:
+		length = net.IPv4len
+	case 4:
+		length = net.IPv6len
+	case 3:
+		if _, err := io.ReadFull(conn, reply[:1]); err != nil {
+			return err
+		}
+		length = int(reply[0])
+	default:
+		return fmt.Errorf("unknown address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, length+2)) // Address and port
+	return err
+}
+
+// Doer sends HTTP requests, satisfied by *http.Client, see Options.Client
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// http3Transport sends the https:// requests of an endpoint over HTTP/3, and
+// the others over its TCP transport. Once a request over HTTP/3 fails, e.g. as
+// UDP is blocked or the server doesn't support it, that request and every
+// later one are sent over TCP instead.
+type http3Transport struct {
+	name   string           // Of the endpoint, for the warning when falling back
+	quic   *http3.Transport // Its QUICConfig gives up on handshakes after half the timeout, leaving time to fall back
+	udp    *quic.Transport  // Connects over the IPVersion, nil for either
+	tcp    *http.Transport
+	failed atomic.Bool // Falling back to tcp for every request
+	opts   *Options
+}
+
+// Build the HTTP/3 transport of an endpoint with the TLS settings of its TCP
+// transport, which it falls back to
+func newHTTP3Transport(site HealthCheck) *http3Transport {
+	t := &http3Transport{
+		name: site.Name,
+		quic: &http3.Transport{
+			TLSClientConfig: site.transport.TLSClientConfig.Clone(),
+			QUICConfig:      &quic.Config{HandshakeIdleTimeout: site.requestTimeout() / 2},
+		},
+		tcp:  site.transport,
+		opts: site.opts,
+	}
+
+	// quic-go listens on both IP versions unless the connections are dialed
+	// over a socket of one of them
+	if network := site.opts.IPNetwork("udp"); network != "udp" {
+		conn, err := net.ListenUDP(network, nil)
+		if err != nil {
+			site.opts.logf("Warning: Unable to listen on %s for HTTP/3, checking %s over TCP: %s\n", network, site.Name, err)
+			t.failed.Store(true)
+			return t
+		}
+		t.udp = &quic.Transport{Conn: conn}
+		t.quic.Dial = func(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (*quic.Conn, error) {
+			udpAddr, err := net.ResolveUDPAddr(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return t.udp.DialEarly(ctx, udpAddr, tlsConf, conf)
+		}
+	}
+	return t
+}
+
+// Send the request over HTTP/3, or TCP if it isn't https://, goes through a
+// proxy from the environment or HTTP/3 failed
+func (t *http3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" || t.failed.Load() {
+		return t.tcp.RoundTrip(req)
+	}
+	if t.tcp.Proxy != nil {
+		if proxy, err := t.tcp.Proxy(req); err != nil || proxy != nil {
+			return t.tcp.RoundTrip(req)
+		}
+	}
+
+	resp, err := t.quic.RoundTrip(req)
+	if err == nil || req.Context().Err() != nil {
+		return resp, err
+	}
+
+	// The body was read by the failed request, so send a new copy of it
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, err
+		}
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	if !t.failed.Swap(true) {
+		t.opts.logf("Warning: Unable to check %s over HTTP/3, checking it over TCP from now on: %s\n", t.name, err)
+	}
+	return t.tcp.RoundTrip(req)
+}
+
+// Close the QUIC connections and socket
+func (t *http3Transport) close() {
+	t.quic.Close()
+	if t.udp != nil {
+		t.udp.Close()
+		t.udp.Conn.Close()
+	}
+}
+
+// HTTPClient returns a client with the Proxy or SOCKS5, RootCAs and IPVersion
+// of the Options, e.g. to download other resources the same way the endpoints
+// are checked. It follows redirects and has no timeout, so every request should
+// have a deadline.
+func (o Options) HTTPClient() *http.Client {
+	return &http.Client{Transport: newTransport(HealthCheck{opts: &o})}
+}
+
+// ClientFunc returns the Doer the requests to an endpoint are sent with, given
+// the client built for it from the Options
+type ClientFunc func(site HealthCheck, client *http.Client) Doer
+
+// Build the HTTP client used for every request to the endpoint
+func newClient(site HealthCheck) *http.Client {
+	client := &http.Client{
+		Timeout: site.requestTimeout(),
+	}
+	if site.http3 != nil {
+		client.Transport = site.http3
+	} else if site.transport != nil {
+		client.Transport = site.transport
+	}
+
+	// Cookies persist for as long as the client, across every check
+	if site.UseCookieJar {
+		client.Jar, _ = cookiejar.New(nil) // Only fails on invalid options
+	}
+
+	// Check the redirect response itself instead of where it points to
+	follow := site.opts.FollowRedirects
+	if site.FollowRedirects != nil {
+		follow = *site.FollowRedirects
+	}
+	if !follow {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client
+}
+
+// The error of checks that couldn't get an OAuth2 token, so weren't sent
+var errToken = errors.New("unable to get an OAuth2 token")
+
+// tokenSource gets and caches the OAuth2 access tokens of an endpoint with the
+// client credentials grant (RFC 6749 section 4.4)
+type tokenSource struct {
+	config    OAuth2
+	client    *http.Client
+	userAgent string
+
+	lock    sync.Mutex // Guards token and expires, and makes the checks share one request
+	token   string
+	expires time.Time // Zero if the token endpoint didn't say
+}
+
+// Refresh tokens this long before they expire, so they don't expire in flight
+const tokenExpiryMargin = 10 * time.Second
+
+// Largest token response that is read
+const maxTokenResponse = 1 << 20
+
+// Get the tokens of an endpoint over its transport, so they use the same
+// proxy and TLS settings
+func newTokenSource(site HealthCheck) *tokenSource {
+	agent := site.opts.UserAgent
+	if site.UserAgent != "" {
+		agent = site.UserAgent
+	}
+	return &tokenSource{
+		config:    *site.OAuth2,
+		client:    &http.Client{Transport: site.transport},
+		userAgent: agent,
+	}
+}
+
+// The cached token, or a new one if there is none or it's about to expire
+func (t *tokenSource) get(ctx context.Context) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.token != "" && (t.expires.IsZero() || time.Until(t.expires) > tokenExpiryMargin) {
+		return t.token, nil
+	}
+	token, expiresIn, err := t.request(ctx)
+	if err != nil {
+		return "", err
+	}
+	t.token, t.expires = token, time.Time{}
+	if expiresIn > 0 {
+		t.expires = time.Now().Add(expiresIn)
+	}
+	return t.token, nil
+}
+
+// Drop the cached token, so the next check gets a new one
+func (t *tokenSource) invalidate() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.token = ""
+}
+
+// Request a token from the token endpoint, returning it and how long it's
+// valid for, 0 if the response doesn't say
+func (t *tokenSource) request(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(t.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(t.config.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", t.userAgent)
+
+	// The client credentials are form encoded before basic authentication,
+	// see RFC 6749 section 2.3.1
+	req.SetBasicAuth(url.QueryEscape(t.config.ClientID), url.QueryEscape(t.config.ClientSecret))
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenResponse))
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to read token response: %w", err)
+	}
+	var token struct {
+		AccessToken      string      `json:"access_token"`
+		TokenType        string      `json:"token_type"`
+		ExpiresIn        json.Number `json:"expires_in"`
+		Error            string      `json:"error"`
+		ErrorDescription string      `json:"error_description"`
+	}
+	decodeErr := json.Unmarshal(body, &token)
+
+	if resp.StatusCode != http.StatusOK {
+		if token.Error != "" {
+			return "", 0, fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, strings.TrimSpace(token.Error+" "+token.ErrorDescription))
+		}
+		return "", 0, fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+	if decodeErr != nil {
+		return "", 0, fmt.Errorf("unable to parse token response: %w", decodeErr)
+	}
+	if token.AccessToken == "" {
+		return "", 0, errors.New("token response has no access_token")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("token_type %q is not supported, only bearer", token.TokenType)
+	}
+
+	var expiresIn time.Duration
+	if token.ExpiresIn != "" {
+		seconds, err := token.ExpiresIn.Int64()
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid expires_in %q", token.ExpiresIn)
+		}
+		expiresIn = time.Duration(seconds) * time.Second
+	}
+	return token.AccessToken, expiresIn, nil
+}
+
+// Check is a simple HTTP health check, returns if the site is UP and if not,
+// why. The site must be one of a Monitor's Endpoints. Failed requests are
+// retried with backoff until the timeout is used up.
+func Check(ctx context.Context, site HealthCheck) CheckResult {
+	client := site.client
+	if client == nil {
+		client = newClient(site)
+	}
+
+	retries := site.opts.Retries
+	if site.Retries != nil {
+		retries = *site.Retries
+	}
+
+	// Templated URLs are rendered once per check, shared by its retries
+	if site.urlTemplate != nil {
+		var count uint64
+		if site.checks != nil {
+			count = site.checks.Add(1)
+		}
+		rendered, err := renderURL(site.urlTemplate, URLVars{Timestamp: time.Now().Unix(), Counter: count})
+		if err != nil {
+			return CheckResult{Err: fmt.Errorf("invalid URL template: %w", err)}
+		}
+		site.URL = rendered
+	}
+
+	// The retries of a check all share the same timeout
+	ctx, cancel := context.WithTimeout(ctx, site.requestTimeout())
+	defer cancel()
+
+	backoff := retryBackoff
+	var sent, received int64
+	for try := 0; ; try++ {
+		var result CheckResult
+		if site.Type == "tcp" {
+			result = dial(ctx, site)
+		} else {
+			result = request(ctx, client, site)
+		}
+		result.Category = errorCategory(result)
+
+		// Every try moves data, not only the one returned
+		sent += result.BytesSent
+		received += result.BytesReceived
+		result.BytesSent, result.BytesReceived = sent, received
+
+		// Slow responses aren't retried since a faster retry would hide that
+		// the endpoint is slow
+		if result.Up || result.Criterion == "latency" || try >= retries {
+			return result
+		}
+
+		select {
+		case <-ctx.Done():
+			return result
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Generate a random (version 4) UUID to identify a request
+func newRequestID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return ""
+	}
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// Simple TCP connect function, returns if the port is open and if not, why
+func dial(ctx context.Context, site HealthCheck) CheckResult {
+	address, _ := url.Parse(site.URL)
+	dialer := net.Dialer{Timeout: site.requestTimeout()}
+
+	start := time.Now()
+	conn, err := site.opts.dialContext(ctx, &dialer, "tcp", address.Host)
+	latency := time.Since(start)
+	if err != nil {
+		return CheckResult{Latency: latency, Err: err}
+	}
+	conn.Close()
+
+	return evaluate(site, &Response{Latency: latency})
+}
+
+// Read up to limit bytes of the decompressed response body, ignoring the rest.
+// The transport only decompresses gzip itself when it asked for it, so
+// responses to an Accept-Encoding set in the config's headers are decompressed
+// here.
+func readBody(resp *http.Response, limit int64) ([]byte, error) {
+	var reader io.Reader = resp.Body
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+
+	if !resp.Uncompressed {
+		switch encoding {
+		case "gzip", "x-gzip":
+			gz, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				return nil, fmt.Errorf("unable to decompress gzip response body: %w", err)
+			}
+			defer gz.Close()
+			reader = gz
+		case "deflate":
+			zr, err := zlib.NewReader(resp.Body)
+			if err != nil {
+				return nil, fmt.Errorf("unable to decompress deflate response body: %w", err)
+			}
+			defer zr.Close()
+			reader = zr
+		}
+	} else {
+		encoding = "gzip"
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, limit))
+	if err != nil {
+		if encoding == "gzip" || encoding == "x-gzip" || encoding == "deflate" {
+			return nil, fmt.Errorf("unable to decompress %s response body: %w", encoding, err)
+		}
+		return nil, fmt.Errorf("unable to read response body: %w", err)
+	}
+	return body, nil
+}
+
+// Headers whose values are redacted from the Verbose output
+var secretHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"X-Api-Key":           true,
+}
+
+// Format headers on a single line sorted by name, redacting secrets
+func formatHeaders(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if secretHeaders[name] {
+			value = "[REDACTED]"
+		}
+		fields = append(fields, fmt.Sprintf("%s: %s", name, value))
+	}
+	return "{" + strings.Join(fields, "; ") + "}"
+}
+
+// Simple HTTP request function, returns if the site is UP and if not, why
+func request(ctx context.Context, client Doer, site HealthCheck) CheckResult {
+	opts := site.opts
+
+	var body []byte
+	if site.sendsBody() {
+		body = []byte(site.Body)
+		if site.BodyFile != "" {
+			data, err := ioutil.ReadFile(site.BodyFilePath())
+			if err != nil {
+				return CheckResult{Err: fmt.Errorf("unable to read body_file: %w", err)}
+			}
+			body = data
+		}
+	}
+
+	// Check with HEAD instead of GET if preferred, unless the body is checked
+	// or the server has already turned HEAD down
+	method := site.RequestMethod()
+	head := opts.PreferHead && method == http.MethodGet && !site.checksBody() &&
+		site.noHead != nil && !site.noHead.Load()
+	if head {
+		method = http.MethodHead
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, site.URL, bytes.NewReader(body))
+	if err != nil {
+		return CheckResult{Err: fmt.Errorf("invalid request: %w", err)}
+	}
+
+	// Add The headers
+	if site.Headers != nil {
+		for k, v := range site.Headers {
+			req.Header.Add(k, v)
+		}
+	}
+
+	// Bodies are JSON, so say so unless the headers set a Content-Type
+	if opts.DefaultContentType && len(body) > 0 && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	// Identify the monitoring traffic, unless the headers set a User-Agent
+	if req.Header.Get("User-Agent") == "" {
+		agent := opts.UserAgent
+		if site.UserAgent != "" {
+			agent = site.UserAgent
+		}
+		req.Header.Set("User-Agent", agent)
+	}
+
+	// Correlation ID, unless the config sets the same header
+	if opts.RequestIDHeader != "" && (opts.RequestIDOverride || req.Header.Get(opts.RequestIDHeader) == "") {
+		req.Header.Set(opts.RequestIDHeader, newRequestID())
+	}
+
+	// Authentication fields take precedence over an Authorization header
+	if site.BasicAuth != nil {
+		req.SetBasicAuth(site.BasicAuth.Username, site.BasicAuth.Password)
+	} else if site.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+site.BearerToken)
+	} else if site.tokens != nil {
+		token, err := site.tokens.get(ctx)
+		if err != nil {
+			return CheckResult{Err: fmt.Errorf("%w: %w", errToken, err)}
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	if opts.Verbose {
+		opts.logf("%s: > %s %s %s\n", site.Name, req.Method, req.URL, formatHeaders(req.Header))
+	}
+
+	// Bodies are sent whatever the response
+	var sent int64
+	if opts.CountBytes {
+		sent = int64(len(body))
+	}
+
+	var trace *requestTrace
+	if opts.Trace {
+		trace = new(requestTrace)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	latency := time.Since(start)
+	if trace != nil {
+		opts.logf("%s: trace %s\n", site.Name, trace)
+	}
+	if err != nil {
+		if opts.Verbose {
+			opts.logf("%s: < error after %s: %s\n", site.Name, latency.Round(time.Millisecond), err)
+		}
+		return CheckResult{Latency: latency, Err: err, BytesSent: sent}
+	}
+
+	if opts.Verbose {
+		opts.logf("%s: < %s in %s\n", site.Name, resp.Status, latency.Round(time.Millisecond))
+	}
+
+	// Servers that don't support HEAD are checked with GET from now on
+	if head && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp.Body.Close()
+		site.noHead.Store(true)
+		return request(ctx, client, site)
+	}
+
+	defer resp.Body.Close()
+
+	// A token the endpoint turns down is replaced by the next try or check,
+	// e.g. if it was revoked before it expired
+	if resp.StatusCode == http.StatusUnauthorized && site.tokens != nil {
+		site.tokens.invalidate()
+	}
+
+	response := &Response{HTTP: resp, Latency: latency, limit: opts.MaxBodyBytes}
+	result := evaluate(site, response)
+
+	// The body is read to count it even if no criterion checked it
+	if opts.CountBytes {
+		received, _ := response.Body()
+		result.BytesSent = sent
+		result.BytesReceived = int64(len(received))
+	}
+	return result
+}
+
+// requestTrace is the time spent in each phase of a request, for Options.Trace
+type requestTrace struct {
+	lock                                 sync.Mutex // Connections may be dialed in parallel
+	start, dnsStart, connStart, tlsStart time.Time
+	dns, connect, tls, firstByte         time.Duration
+	reused                               bool
+}
+
+// Hooks that record the phases of a request
+func (t *requestTrace) clientTrace() *httptrace.ClientTrace {
+	since := func(start *time.Time, d *time.Duration) {
+		t.lock.Lock()
+		*d = time.Since(*start)
+		t.lock.Unlock()
+	}
+	now := func(start *time.Time) {
+		t.lock.Lock()
+		*start = time.Now()
+		t.lock.Unlock()
+	}
+	return &httptrace.ClientTrace{
+		GetConn:              func(string) { now(&t.start) },
+		DNSStart:             func(httptrace.DNSStartInfo) { now(&t.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { since(&t.dnsStart, &t.dns) },
+		ConnectStart:         func(string, string) { now(&t.connStart) },
+		ConnectDone:          func(string, string, error) { since(&t.connStart, &t.connect) },
+		TLSHandshakeStart:    func() { now(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { since(&t.tlsStart, &t.tls) },
+		GotFirstResponseByte: func() { since(&t.start, &t.firstByte) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.lock.Lock()
+			t.reused = info.Reused
+			t.lock.Unlock()
+		},
+	}
+}
+
+// e.g. "dns 1.2ms, connect 3.4ms, tls 10.5ms, first byte 52.1ms"
+func (t *requestTrace) String() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.reused {
+		return fmt.Sprintf("reused connection, first byte %s", t.firstByte.Round(time.Microsecond))
+	}
+	return fmt.Sprintf("dns %s, connect %s, tls %s, first byte %s", t.dns.Round(time.Microsecond),
+		t.connect.Round(time.Microsecond), t.tls.Round(time.Microsecond), t.firstByte.Round(time.Microsecond))
+}
+
+// Response is what the UP criteria are evaluated against. HTTP is nil for TCP
+// checks, which only have a latency.
+type Response struct {
+	HTTP    *http.Response
+	Latency time.Duration
+	limit   int64 // Options.MaxBodyBytes
+	body    []byte
+	bodyErr error
+	read    bool
+}
+
+// Read the HTTP response body, only once however many criteria need it. Only
+// the first Options.MaxBodyBytes are read.
+func (r *Response) Body() ([]byte, error) {
+	if !r.read {
+		r.body, r.bodyErr = readBody(r.HTTP, r.limit)
+		r.read = true
+	}
+	return r.body, r.bodyErr
+}
+
+// Criterion is one of the UP criteria of an endpoint. Check returns why the
+// response fails it, or nil if it passes or doesn't apply. It's also called
+// for TCP checks, whose Response has no HTTP. Extra criteria can be added with
+// Options.Criteria.
+type Criterion struct {
+	Name  string
+	Check func(site HealthCheck, resp *Response) error
+}
+
+// The UP criteria of every response, evaluated in order until one fails
+var criteria = []Criterion{
+	{Name: "protocol", Check: checkProtocol},
+	{Name: "status", Check: checkStatus},
+	{Name: "content_type", Check: checkContentType},
+	{Name: "body", Check: checkBody},
+	{Name: "latency", Check: checkLatency},
+}
+
+// Evaluate the UP criteria and then the Options.Criteria against a response,
+// the endpoint is UP if it passes all of them
+func evaluate(site HealthCheck, resp *Response) CheckResult {
+	result := CheckResult{Latency: resp.Latency}
+	if resp.HTTP != nil {
+		result.StatusCode = resp.HTTP.StatusCode
+	}
+
+	for _, list := range [][]Criterion{criteria, site.opts.Criteria} {
+		for _, criterion := range list {
+			if err := criterion.Check(site, resp); err != nil {
+				result.Err = err
+				result.Criterion = criterion.Name
+				return result
+			}
+		}
+	}
+	result.Up = true
+	return result
+}
+
+// The response must have been sent over HTTP/2 if the HTTPVersion requires it
+func checkProtocol(site HealthCheck, resp *Response) error {
+	if resp.HTTP == nil || site.opts.HTTPVersion != "2" || resp.HTTP.ProtoMajor == 2 {
+		return nil
+	}
+	return fmt.Errorf("response over %s rather than HTTP/2", resp.HTTP.Proto)
+}
+
+// Response code must be between 200 and 299 (or one of the expected status
+// codes) otherwise it is considered down
+func checkStatus(site HealthCheck, resp *Response) error {
+	if resp.HTTP == nil || site.expectedStatus(resp.HTTP.StatusCode) {
+		return nil
+	}
+	return fmt.Errorf("unexpected status code %d", resp.HTTP.StatusCode)
+}
+
+// The content type must match, if configured. Prefix matching ignores
+// parameters such as "; charset=utf-8"
+func checkContentType(site HealthCheck, resp *Response) error {
+	if resp.HTTP == nil || site.ExpectContentType == "" {
+		return nil
+	}
+	contentType := resp.HTTP.Header.Get("Content-Type")
+	if !strings.HasPrefix(strings.ToLower(contentType), strings.ToLower(site.ExpectContentType)) {
+		return fmt.Errorf("unexpected content type %q, expected %q", contentType, site.ExpectContentType)
+	}
+	return nil
+}
+
+// The response body must match, if configured
+func checkBody(site HealthCheck, resp *Response) error {
+	if resp.HTTP == nil || !site.checksBody() {
+		return nil
+	}
+	body, err := resp.Body()
+	if err != nil {
+		return err
+	}
+	if site.ExpectBodyContains != "" && !bytes.Contains(body, []byte(site.ExpectBodyContains)) {
+		return fmt.Errorf("response body does not contain %q", site.ExpectBodyContains)
+	}
+	if site.bodyRegex != nil && !site.bodyRegex.Match(body) {
+		return fmt.Errorf("response body does not match %q", site.ExpectBodyRegex)
+	}
+
+	// A body cut off at the limit can't match the hash of the whole one
+	if site.ExpectSHA256 != "" {
+		if int64(len(body)) >= resp.limit {
+			return fmt.Errorf("response body reached the limit of %d bytes, so its SHA-256 can't be checked", resp.limit)
+		}
+		if sum := sha256.Sum256(body); !strings.EqualFold(hex.EncodeToString(sum[:]), site.ExpectSHA256) {
+			return fmt.Errorf("response body SHA-256 is %x, expected %s", sum, strings.ToLower(site.ExpectSHA256))
+		}
+	}
+	return nil
+}
+
+// Responses over the latency budget are DOWN even though they arrived in time
+func checkLatency(site HealthCheck, resp *Response) error {
+	budget := site.opts.LatencyBudget
+	if budget == 0 || resp.Latency <= budget {
+		return nil
+	}
+	return fmt.Errorf("slow response in %s, over the latency budget of %s", resp.Latency.Round(time.Millisecond), budget)
+}
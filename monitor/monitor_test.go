@@ -0,0 +1,1131 @@
+package monitor
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Options for tests, with a short timeout and without redirects followed
+func testOptions() Options {
+	opts := DefaultOptions()
+	opts.Timeout = 200 * time.Millisecond
+	opts.FollowRedirects = false
+	return opts
+}
+
+// Prepare a single endpoint with opts, as a Monitor's Endpoints are
+func prepareEndpoint(t *testing.T, hc HealthCheck, opts Options) HealthCheck {
+	t.Helper()
+	m, err := New([]HealthCheck{hc}, opts)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	return m.Endpoints()[0]
+}
+
+func TestCheckStatus(t *testing.T) {
+	// Respond with the status code in the path, e.g. /503
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if code >= 300 && code < 400 {
+			w.Header().Set("Location", "/200")
+		}
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		status int
+		up     bool
+	}{
+		{200, true},
+		{204, true},
+		{299, true},
+		{301, false},
+		{302, false},
+		{400, false},
+		{404, false},
+		{500, false},
+		{503, false},
+	}
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.status), func(t *testing.T) {
+			site := prepareEndpoint(t, HealthCheck{Name: "site", URL: server.URL + "/" + strconv.Itoa(test.status)}, testOptions())
+			res := Check(context.Background(), site)
+			if res.Up != test.up {
+				t.Errorf("Up = %t, want %t (err: %v)", res.Up, test.up, res.Err)
+			}
+			if res.StatusCode != test.status {
+				t.Errorf("StatusCode = %d, want %d", res.StatusCode, test.status)
+			}
+			if !test.up && (res.Criterion != "status" || res.Category != "status") {
+				t.Errorf("Criterion, Category = %q, %q, want status", res.Criterion, res.Category)
+			}
+		})
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	opts := testOptions()
+	opts.Timeout = 50 * time.Millisecond
+	site := prepareEndpoint(t, HealthCheck{Name: "slow", URL: server.URL}, opts)
+
+	start := time.Now()
+	res := Check(context.Background(), site)
+	if res.Up {
+		t.Fatal("Up = true, want false")
+	}
+	if res.Category != "timeout" {
+		t.Errorf("Category = %q, want timeout (err: %v)", res.Category, res.Err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Check took %s, want about the 50ms timeout", elapsed)
+	}
+}
+
+func TestCheckSendsHeadersAndBody(t *testing.T) {
+	var got *http.Request
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		got, body = r, string(data)
+	}))
+	defer server.Close()
+
+	site := prepareEndpoint(t, HealthCheck{
+		Name:    "post",
+		URL:     server.URL + "/orders",
+		Method:  "POST",
+		Headers: map[string]string{"X-Team": "payments"},
+		Body:    `{"id": 1}`,
+	}, testOptions())
+
+	res := Check(context.Background(), site)
+	if !res.Up {
+		t.Fatalf("Up = false, want true (err: %v)", res.Err)
+	}
+	if got.Method != "POST" || got.URL.Path != "/orders" {
+		t.Errorf("request = %s %s, want POST /orders", got.Method, got.URL.Path)
+	}
+	if body != `{"id": 1}` {
+		t.Errorf("body = %q, want the endpoint's body", body)
+	}
+	for name, want := range map[string]string{
+		"X-Team":       "payments",
+		"Content-Type": "application/json",
+		"User-Agent":   "fetch-sre",
+	} {
+		if value := got.Header.Get(name); value != want {
+			t.Errorf("%s header = %q, want %q", name, value, want)
+		}
+	}
+}
+
+// Doer that answers every request with a status code without sending it
+type stubDoer struct {
+	status   int
+	requests []*http.Request
+}
+
+func (d *stubDoer) Do(req *http.Request) (*http.Response, error) {
+	d.requests = append(d.requests, req)
+	return &http.Response{
+		StatusCode: d.status,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func TestOptionsClient(t *testing.T) {
+	stub := &stubDoer{status: http.StatusServiceUnavailable}
+	opts := testOptions()
+	opts.Client = func(site HealthCheck, client *http.Client) Doer {
+		if client == nil || client.Timeout != opts.Timeout {
+			t.Errorf("client built for %s = %+v, want one with the timeout", site.Name, client)
+		}
+		return stub
+	}
+	site := prepareEndpoint(t, HealthCheck{Name: "stubbed", URL: "http://example.invalid/health"}, opts)
+
+	res := Check(context.Background(), site)
+	if res.Up || res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Up, StatusCode = %t, %d, want false, 503", res.Up, res.StatusCode)
+	}
+	if len(stub.requests) != 1 || stub.requests[0].URL.Host != "example.invalid" {
+		t.Errorf("stub got %d requests, want 1 to example.invalid", len(stub.requests))
+	}
+}
+
+func TestRingKeepsTheNewestValues(t *testing.T) {
+	tests := []struct {
+		size   int
+		pushed int
+		want   []int
+	}{
+		{0, 10, []int{}},
+		{3, 0, []int{}},
+		{3, 2, []int{1, 2}},
+		{3, 3, []int{1, 2, 3}},
+		{3, 4, []int{2, 3, 4}},
+		{3, 7, []int{5, 6, 7}},
+		{3, 1000, []int{998, 999, 1000}},
+	}
+	for _, test := range tests {
+		r := newRing[int](test.size)
+		for i := 1; i <= test.pushed; i++ {
+			r.push(i)
+		}
+		if r.len() != len(test.want) {
+			t.Errorf("ring of %d after %d pushes: len = %d, want %d", test.size, test.pushed, r.len(), len(test.want))
+		}
+		if got := r.items(); !equalInts(got, test.want) {
+			t.Errorf("ring of %d after %d pushes: items = %v, want %v", test.size, test.pushed, got, test.want)
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestResultHistoryIsBounded(t *testing.T) {
+	opts := testOptions()
+	opts.Window = 10
+	opts.HistorySize = 20
+	r := newResult(HealthCheck{opts: &opts})
+
+	// Far more attempts than either buffer holds, the last 10 all UP
+	for i := 0; i < 10000; i++ {
+		r.record(CheckResult{Up: i%2 == 0 || i >= 9990, Latency: time.Duration(i) * time.Millisecond})
+	}
+	if len(r.recent.values) != opts.Window {
+		t.Errorf("len(recent.values) = %d, want the window of %d", len(r.recent.values), opts.Window)
+	}
+	if len(r.samples.values) != opts.HistorySize {
+		t.Errorf("len(samples.values) = %d, want the history size of %d", len(r.samples.values), opts.HistorySize)
+	}
+	if success, attempt := r.Counts(); success != 10 || attempt != 10 {
+		t.Errorf("Counts = %v, %v, want 10, 10 over the window", success, attempt)
+	}
+	if r.Attempt != 10000 {
+		t.Errorf("Attempt = %v, want every attempt counted", r.Attempt)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	opts := testOptions()
+	opts.HistorySize = 100
+	r := newResult(HealthCheck{opts: &opts})
+	if got := r.Percentile(95); got != 0 {
+		t.Errorf("Percentile(95) without samples = %s, want 0", got)
+	}
+
+	// 1ms to 100ms in a shuffled order, then 1ms to 100ms again overwriting them
+	for _, pass := range []int{37, 1} {
+		for i := 0; i < 100; i++ {
+			ms := (i*pass)%100 + 1
+			r.record(CheckResult{Up: true, Latency: time.Duration(ms) * time.Millisecond})
+		}
+	}
+
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, 1 * time.Millisecond},
+		{1, 1 * time.Millisecond},
+		{50, 50 * time.Millisecond},
+		{95, 95 * time.Millisecond},
+		{99, 99 * time.Millisecond},
+		{99.5, 100 * time.Millisecond},
+		{100, 100 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if got := r.Percentile(test.p); got != test.want {
+			t.Errorf("Percentile(%v) = %s, want %s", test.p, got, test.want)
+		}
+	}
+
+	// Only the HistorySize newest samples count, 91ms to 100ms
+	opts.HistorySize = 10
+	r = newResult(HealthCheck{opts: &opts})
+	for ms := 1; ms <= 100; ms++ {
+		r.record(CheckResult{Up: true, Latency: time.Duration(ms) * time.Millisecond})
+	}
+	if got := r.Percentile(50); got != 95*time.Millisecond {
+		t.Errorf("Percentile(50) of the newest 10 = %s, want 95ms", got)
+	}
+	if got := r.Percentile(0); got != 91*time.Millisecond {
+		t.Errorf("Percentile(0) of the newest 10 = %s, want 91ms", got)
+	}
+}
+
+func TestParseMergeKeys(t *testing.T) {
+	three := 3
+	tests := []struct {
+		name   string
+		config string
+		want   []HealthCheck
+	}{
+		{
+			name: "bare list",
+			config: `
+- &base
+  name: a
+  url: http://a/
+  headers: {X-Team: infra}
+- <<: *base
+  name: b
+`,
+			want: []HealthCheck{
+				{Name: "a", URL: "http://a/", Headers: map[string]string{"X-Team": "infra"}},
+				{Name: "b", URL: "http://a/", Headers: map[string]string{"X-Team": "infra"}},
+			},
+		},
+		{
+			name: "defaults merged key by key",
+			config: `
+defaults:
+  timeout: 2s
+  headers: {Accept: text/plain, X-Team: infra}
+endpoints:
+  - &auth
+    name: a
+    url: http://a/
+    headers: &headers {Authorization: Bearer x}
+  - <<: *auth
+    name: b
+    timeout: 1s
+    headers:
+      <<: *headers
+      X-Team: payments
+`,
+			want: []HealthCheck{
+				{Name: "a", URL: "http://a/", Timeout: "2s", Headers: map[string]string{
+					"Authorization": "Bearer x", "Accept": "text/plain", "X-Team": "infra",
+				}},
+				{Name: "b", URL: "http://a/", Timeout: "1s", Headers: map[string]string{
+					"Authorization": "Bearer x", "Accept": "text/plain", "X-Team": "payments",
+				}},
+			},
+		},
+		{
+			name: "sequence of merges",
+			config: `
+- &fast {name: fast, url: http://fast/, timeout: 1s}
+- &retry {name: retry, url: http://retry/, timeout: 5s, retries: 3}
+- <<: [*fast, *retry]
+  name: both
+`,
+			want: []HealthCheck{
+				{Name: "fast", URL: "http://fast/", Timeout: "1s"},
+				{Name: "retry", URL: "http://retry/", Timeout: "5s", Retries: &three},
+				{Name: "both", URL: "http://fast/", Timeout: "1s", Retries: &three},
+			},
+		},
+		{
+			name: "alias as a whole value",
+			config: `
+defaults:
+  headers: &team {X-Team: infra}
+endpoints:
+  - name: a
+    url: http://a/
+    labels: *team
+    basic_auth: &creds {username: u, password: p}
+  - name: b
+    url: http://b/
+    basic_auth: *creds
+`,
+			want: []HealthCheck{
+				{Name: "a", URL: "http://a/", Headers: map[string]string{"X-Team": "infra"},
+					Labels: map[string]string{"X-Team": "infra"}, BasicAuth: &BasicAuth{Username: "u", Password: "p"}},
+				{Name: "b", URL: "http://b/", Headers: map[string]string{"X-Team": "infra"},
+					BasicAuth: &BasicAuth{Username: "u", Password: "p"}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Parse([]byte(test.config))
+			if err != nil {
+				t.Fatalf("Parse: %s", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Parse =\n%+v\nwant\n%+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateEntriesWeight(t *testing.T) {
+	weight := func(w float64) *float64 { return &w }
+	tests := []struct {
+		name   string
+		weight *float64
+		want   string // Problem found, empty for none
+	}{
+		{"unset", nil, ""},
+		{"zero", weight(0), ""},
+		{"positive", weight(2.5), ""},
+		{"negative", weight(-1), "weight must be a non-negative number, got -1"},
+		{"NaN", weight(math.NaN()), "weight must be a non-negative number, got NaN"},
+		{"+Inf", weight(math.Inf(1)), "weight must be finite, got +Inf"},
+		{"-Inf", weight(math.Inf(-1)), "weight must be a non-negative number, got -Inf"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problems := ValidateEntries([]HealthCheck{{Name: "site", URL: "https://example.com", Weight: test.weight}}, false)[0]
+			var got []string
+			for _, problem := range problems {
+				got = append(got, problem.Error())
+			}
+			var want []string
+			if test.want != "" {
+				want = []string{test.want}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("problems %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestValidateDependencies(t *testing.T) {
+	tests := []struct {
+		name      string
+		endpoints []HealthCheck
+		want      []string // Problem of each entry, empty if there's none
+	}{
+		{
+			name:      "valid chain",
+			endpoints: []HealthCheck{{Name: "a"}, {Name: "b", DependsOn: "a"}, {Name: "c", DependsOn: "b"}},
+			want:      []string{"", "", ""},
+		},
+		{
+			name:      "unknown",
+			endpoints: []HealthCheck{{Name: "a", DependsOn: "z"}},
+			want:      []string{`depends_on "z" is not the name of an endpoint`},
+		},
+		{
+			name:      "itself",
+			endpoints: []HealthCheck{{Name: "a", DependsOn: "a"}},
+			want:      []string{"depends_on can't be the endpoint itself"},
+		},
+		{
+			name:      "cycle",
+			endpoints: []HealthCheck{{Name: "a", DependsOn: "b"}, {Name: "b", DependsOn: "a"}, {Name: "c", DependsOn: "a"}},
+			want:      []string{"depends_on cycle a -> b -> a", "depends_on cycle b -> a -> b", ""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i, problems := range ValidateDependencies(test.endpoints) {
+				var got string
+				if len(problems) > 0 {
+					got = problems[0].Error()
+				}
+				if len(problems) > 1 || got != test.want[i] {
+					t.Errorf("%s: problems = %q, want %q", test.endpoints[i].Name, problems, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRunOnceChecksDependenciesFirst(t *testing.T) {
+	// Record the order the endpoints are checked in, the ones without a
+	// dependency answering slowly so they'd finish last if nothing waited
+	var lock sync.Mutex
+	var order []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("slow") != "" {
+			time.Sleep(30 * time.Millisecond)
+		}
+		lock.Lock()
+		order = append(order, strings.TrimPrefix(r.URL.Path, "/"))
+		lock.Unlock()
+		code, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		if code != 0 {
+			w.WriteHeader(code)
+		}
+	}))
+	defer server.Close()
+
+	disabled := false
+	m, err := New([]HealthCheck{
+		{Name: "app", URL: server.URL + "/app", DependsOn: "gateway"},
+		{Name: "worker", URL: server.URL + "/worker", DependsOn: "app"},
+		{Name: "gateway", URL: server.URL + "/gateway?slow=1"},
+		{Name: "report", URL: server.URL + "/report", DependsOn: "db"},
+		{Name: "db", URL: server.URL + "/db?slow=1&status=503"},
+		{Name: "cache", URL: server.URL + "/cache?slow=1", Enabled: &disabled},
+		{Name: "web", URL: server.URL + "/web", DependsOn: "cache"},
+	}, testOptions())
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	m.RunOnce(context.Background())
+
+	position := make(map[string]int)
+	for i, name := range order {
+		position[name] = i
+	}
+	for _, name := range []string{"gateway", "app", "worker", "db", "web"} {
+		if _, ok := position[name]; !ok {
+			t.Errorf("%s wasn't checked, checks: %q", name, order)
+		}
+	}
+	if position["gateway"] > position["app"] || position["app"] > position["worker"] {
+		t.Errorf("checked in the order %q, want gateway before app before worker", order)
+	}
+
+	sites := m.Results().Sites
+	if _, ok := position["report"]; ok || !sites["report"].Skipped {
+		t.Errorf("report was checked with its dependency DOWN, want it skipped")
+	}
+	if _, ok := position["cache"]; ok || sites["web"].Skipped {
+		t.Errorf("web was skipped, want its disabled dependency ignored")
+	}
+}
+
+func TestShuffle(t *testing.T) {
+	var lock sync.Mutex
+	var order []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		order = append(order, strings.TrimPrefix(r.URL.Path, "/"))
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	names := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	var endpoints []HealthCheck
+	for _, name := range names {
+		endpoints = append(endpoints, HealthCheck{Name: name, URL: server.URL + "/" + name})
+	}
+	opts := testOptions()
+	opts.Interval = 100 * time.Millisecond
+	opts.Concurrency = 1
+	opts.Shuffle = true
+	opts.Seed = 42
+	m, err := New(endpoints, opts)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	// Every cycle the slot goes to the endpoints in the next permutation
+	// drawn from the seed: the first cycle's, then those of the intervals
+	rng := mathrand.New(mathrand.NewSource(opts.Seed))
+	var want [][]string
+	for i := 0; i < 3; i++ {
+		cycle := append([]string(nil), names...)
+		rng.Shuffle(len(cycle), func(i, j int) { cycle[i], cycle[j] = cycle[j], cycle[i] })
+		want = append(want, cycle)
+	}
+
+	m.RunOnce(context.Background())
+	m.Start(context.Background())
+	deadline := time.Now().Add(time.Second)
+	for {
+		lock.Lock()
+		checks := len(order)
+		lock.Unlock()
+		if checks >= len(want)*len(names) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.Stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	for i, cycle := range want {
+		if len(order) < (i+1)*len(names) {
+			t.Fatalf("%d checks, want %d cycles of %d", len(order), len(want), len(names))
+		}
+		if got := order[i*len(names) : (i+1)*len(names)]; !reflect.DeepEqual(got, cycle) {
+			t.Errorf("cycle %d checked in the order %q, want %q", i+1, got, cycle)
+		}
+	}
+	if reflect.DeepEqual(want[0], names) || reflect.DeepEqual(want[0], want[1]) {
+		t.Errorf("the seed draws the orders %q, want them shuffled", want)
+	}
+}
+
+func TestReloadDoesNotWaitForChecks(t *testing.T) {
+	// The first check of the slow endpoint hangs until released, noting if it
+	// was cancelled instead, the others answer right away
+	arrived, release, finished := make(chan struct{}), make(chan struct{}), make(chan bool, 1)
+	var first sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			first.Do(func() {
+				close(arrived)
+				select {
+				case <-release:
+					finished <- true
+				case <-r.Context().Done():
+					finished <- false
+				}
+			})
+		}
+	}))
+	defer server.Close()
+
+	opts := testOptions()
+	opts.Timeout = 5 * time.Second
+	opts.Interval = 20 * time.Millisecond
+	opts.CycleTimeout = 5 * time.Second
+	m, err := New([]HealthCheck{
+		{Name: "slow", URL: server.URL + "/slow"},
+		{Name: "kept", URL: server.URL + "/kept"},
+	}, opts)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	var lock sync.Mutex
+	var checked []string
+	m.OnResult = func(site HealthCheck, res CheckResult) {
+		lock.Lock()
+		defer lock.Unlock()
+		checked = append(checked, site.Name)
+	}
+	m.Start(context.Background())
+	defer m.Stop()
+	<-arrived
+
+	// Reloading doesn't wait for the slow check, which is still in flight
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		added, removed, err := m.Reload([]HealthCheck{
+			{Name: "kept", URL: server.URL + "/kept"},
+			{Name: "new", URL: server.URL + "/new"},
+		})
+		if err != nil || !reflect.DeepEqual(added, []string{"new"}) || !reflect.DeepEqual(removed, []string{"slow"}) {
+			t.Errorf("Reload = %q, %q, %v, want new added and slow removed", added, removed, err)
+		}
+	}()
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		close(release)
+		t.Fatalf("Reload waited for the check in flight")
+	}
+
+	// It's left to finish rather than cancelled, which the server would
+	// notice by then, and then the outcome of the removed endpoint is dropped
+	time.Sleep(5 * opts.Interval)
+	close(release)
+	select {
+	case ok := <-finished:
+		if !ok {
+			t.Errorf("the check in flight was cancelled by Reload")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the check in flight didn't finish")
+	}
+	time.Sleep(10 * opts.Interval)
+	m.Stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, name := range checked {
+		if name == "slow" {
+			t.Errorf("the check of the removed endpoint was recorded, checks: %q", checked)
+			break
+		}
+	}
+	results := m.Results()
+	results.Lock()
+	defer results.Unlock()
+	if _, ok := results.Sites["slow"]; ok {
+		t.Errorf("the removed endpoint has results")
+	}
+	if res := results.Sites["new"]; res == nil || res.Attempt == 0 {
+		t.Errorf("the added endpoint wasn't checked")
+	}
+}
+
+func TestHTTPVersion(t *testing.T) {
+	// Servers answering with the protocol the request was sent over
+	proto := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})
+	h2c := httptest.NewUnstartedServer(proto)
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetHTTP1(true)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+	h1 := httptest.NewServer(proto)
+	defer h1.Close()
+	h2 := httptest.NewUnstartedServer(proto)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	h1TLS := httptest.NewTLSServer(proto)
+	defer h1TLS.Close()
+
+	tests := []struct {
+		name    string
+		version string
+		url     string
+		want    string // Protocol of the response, empty if it's DOWN
+	}{
+		{"http:// over h2c", "2", h2c.URL, "HTTP/2.0"},
+		{"http:// without h2c", "2", h1.URL, ""},
+		{"https:// over h2", "2", h2.URL, "HTTP/2.0"},
+		{"https:// without h2", "2", h1TLS.URL, ""},
+		{"http:// pinned to 1.1", "1.1", h2c.URL, "HTTP/1.1"},
+		{"https:// pinned to 1.1", "1.1", h2.URL, "HTTP/1.1"},
+		{"https:// negotiated", "auto", h2.URL, "HTTP/2.0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.HTTPVersion = test.version
+			site := prepareEndpoint(t, HealthCheck{Name: "site", URL: test.url, InsecureSkipVerify: true}, opts)
+			res := Check(context.Background(), site)
+			if test.want == "" {
+				if res.Up {
+					t.Errorf("Up = true, want DOWN without HTTP/2")
+				}
+				return
+			}
+			if !res.Up {
+				t.Fatalf("Up = false (err: %v)", res.Err)
+			}
+
+			// The protocol the server saw is the one the check used
+			site.ExpectBodyRegex = "^" + regexp.QuoteMeta(test.want) + "$"
+			site.bodyRegex = regexp.MustCompile(site.ExpectBodyRegex)
+			if res := Check(context.Background(), site); !res.Up {
+				t.Errorf("not sent over %s (err: %v)", test.want, res.Err)
+			}
+		})
+	}
+}
+
+func TestHTTP3(t *testing.T) {
+	// The TCP server and, on the same port over UDP, the HTTP/3 one both
+	// answer with the protocol of the request
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	opts := testOptions()
+	opts.HTTP3 = true
+	opts.RootCAs = roots
+
+	t.Run("over HTTP/3", func(t *testing.T) {
+		udp, err := net.ListenPacket("udp", server.Listener.Addr().String())
+		if err != nil {
+			t.Skipf("Unable to listen on UDP: %s", err)
+		}
+		h3 := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(server.TLS)}
+		go h3.Serve(udp)
+		defer h3.Close()
+
+		for _, version := range []string{"auto", "4"} {
+			opts := opts
+			opts.IPVersion = version
+			site := prepareEndpoint(t, HealthCheck{Name: "h3", URL: server.URL, ExpectBodyContains: "HTTP/3"}, opts)
+			if res := Check(context.Background(), site); !res.Up {
+				t.Errorf("IP version %s: Up = false, want the request sent over HTTP/3 (err: %v)", version, res.Err)
+			}
+			site.http3.close()
+		}
+	})
+
+	t.Run("falls back to TCP", func(t *testing.T) {
+		var log strings.Builder
+		opts := opts
+		opts.Log = &log
+		site := prepareEndpoint(t, HealthCheck{Name: "tcp", URL: server.URL, Method: "POST", Body: "{}", ExpectBodyContains: "HTTP/1.1"}, opts)
+		for i := 0; i < 2; i++ {
+			if res := Check(context.Background(), site); !res.Up {
+				t.Errorf("check %d: Up = false, want the request sent over TCP (err: %v)", i+1, res.Err)
+			}
+		}
+		if got := strings.Count(log.String(), "over HTTP/3"); got != 1 {
+			t.Errorf("logged %q, want one warning about falling back", log.String())
+		}
+	})
+}
+
+func TestOptionsCriteria(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Version", r.URL.Query().Get("version"))
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	opts := testOptions()
+	opts.Criteria = []Criterion{{
+		Name: "version",
+		Check: func(site HealthCheck, resp *Response) error {
+			if resp.HTTP == nil || resp.HTTP.Header.Get("X-Version") == "2" {
+				return nil
+			}
+			return errors.New("not version 2")
+		},
+	}}
+
+	tests := []struct {
+		query     string
+		up        bool
+		criterion string
+	}{
+		{"version=2", true, ""},
+		{"version=1", false, "version"},
+		{"version=1&fail=1", false, "status"}, // The built-in criteria come first
+	}
+	for _, test := range tests {
+		site := prepareEndpoint(t, HealthCheck{Name: "site", URL: server.URL + "/?" + test.query}, opts)
+		res := Check(context.Background(), site)
+		if res.Up != test.up || res.Criterion != test.criterion {
+			t.Errorf("%s: Up, Criterion = %t, %q, want %t, %q", test.query, res.Up, res.Criterion, test.up, test.criterion)
+		}
+	}
+
+	opts.Criteria = []Criterion{{Name: "incomplete"}}
+	if _, err := New(nil, opts); err == nil {
+		t.Error("New accepted a criterion without a check")
+	}
+}
+
+// Serve one SOCKS5 handshake on conn as the proxy, requiring the username and
+// password if username is set, and answer the CONNECT with status. Returns the
+// address the client asked to connect to.
+func serveSOCKS5(conn net.Conn, username, password string, status byte) (string, error) {
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return "", err
+	}
+	method := greeting[2]
+	if username != "" && method != 2 {
+		conn.Write([]byte{5, 0xff})
+		return "", errors.New("no acceptable method")
+	}
+	conn.Write([]byte{5, method})
+
+	if method == 2 {
+		read := func() string {
+			length := make([]byte, 1)
+			io.ReadFull(conn, length)
+			value := make([]byte, length[0])
+			io.ReadFull(conn, value)
+			return string(value)
+		}
+		version := make([]byte, 1)
+		io.ReadFull(conn, version)
+		if read() != username || read() != password {
+			conn.Write([]byte{1, 1})
+			return "", errors.New("rejected")
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	var host string
+	switch header[3] {
+	case 1, 4:
+		ip := make(net.IP, map[byte]int{1: net.IPv4len, 4: net.IPv6len}[header[3]])
+		io.ReadFull(conn, ip)
+		host = ip.String()
+	case 3:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		name := make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+	conn.Write([]byte{5, status, 0, 1, 127, 0, 0, 1, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     *url.Userinfo // Of the client
+		username string        // Required by the proxy, if set
+		status   byte
+		addr     string
+		err      string
+	}{
+		{name: "hostname", addr: "example.com:80"},
+		{name: "IPv4", addr: "10.0.0.1:443"},
+		{name: "IPv6", addr: "[2001:db8::1]:8080"},
+		{name: "password", user: url.UserPassword("u", "p"), username: "u", addr: "example.com:80"},
+		{name: "wrong password", user: url.UserPassword("u", "x"), username: "u", addr: "example.com:80", err: "username and password rejected"},
+		{name: "password required", username: "u", addr: "example.com:80", err: "no acceptable authentication method"},
+		{name: "refused", status: 5, addr: "example.com:80", err: "unable to connect to example.com:80: connection refused"},
+		{name: "unknown reply", status: 42, addr: "example.com:80", err: "unable to connect to example.com:80: reply code 42"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, proxy := net.Pipe()
+			defer client.Close()
+			target := make(chan string, 1)
+			go func() {
+				defer proxy.Close()
+				addr, _ := serveSOCKS5(proxy, test.username, "p", test.status)
+				target <- addr
+			}()
+
+			err := socks5Connect(client, test.user, test.addr)
+			if test.err == "" && err != nil {
+				t.Fatalf("socks5Connect: %s", err)
+			}
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("socks5Connect error = %v, want %s", err, test.err)
+				}
+				return
+			}
+			if got := <-target; got != test.addr {
+				t.Errorf("proxy was asked for %s, want %s", got, test.addr)
+			}
+		})
+	}
+}
+
+func TestCheckThroughSOCKS5(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// Proxy every connection to the address it's asked for
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				addr, err := serveSOCKS5(conn, "u", "p", 0)
+				if err != nil {
+					return
+				}
+				upstream, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	opts := testOptions()
+	opts.SOCKS5 = &url.URL{Scheme: "socks5", Host: listener.Addr().String(), User: url.UserPassword("u", "p")}
+	for _, site := range []HealthCheck{
+		{Name: "http", URL: server.URL},
+		{Name: "tcp", Type: "tcp", URL: "tcp://" + server.Listener.Addr().String()},
+	} {
+		if res := Check(context.Background(), prepareEndpoint(t, site, opts)); !res.Up {
+			t.Errorf("%s: Up = false, want it checked through the proxy (err: %v)", site.Name, res.Err)
+		}
+	}
+
+	opts.SOCKS5.User = url.UserPassword("u", "wrong")
+	if res := Check(context.Background(), prepareEndpoint(t, HealthCheck{Name: "http", URL: server.URL}, opts)); res.Up {
+		t.Error("Up = true, want the proxy to reject the password")
+	}
+}
+
+// OAuth2 token endpoint issuing token-1, token-2 and so on, and an API that
+// only accepts the latest token issued
+type oauth2Server struct {
+	tokens    *httptest.Server
+	api       *httptest.Server
+	expiresIn string // expires_in of the tokens, omitted if empty
+	fail      bool   // The token endpoint answers with an error
+
+	lock    sync.Mutex
+	issued  int
+	revoked bool // The API turns down every token issued so far
+}
+
+func newOAuth2Server(t *testing.T) *oauth2Server {
+	s := &oauth2Server{}
+	s.tokens = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		r.ParseForm()
+		if id != "client" || secret != "s3cret" || r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("scope") != "read write" {
+			t.Errorf("token request from %q:%q with %v", id, secret, r.Form)
+		}
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.fail {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":"invalid_client"}`)
+			return
+		}
+		s.issued++
+		s.revoked = false
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer"`, s.issued)
+		if s.expiresIn != "" {
+			fmt.Fprintf(w, `,"expires_in":%s`, s.expiresIn)
+		}
+		io.WriteString(w, "}")
+	}))
+	s.api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.revoked || r.Header.Get("Authorization") != fmt.Sprintf("Bearer token-%d", s.issued) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	t.Cleanup(s.tokens.Close)
+	t.Cleanup(s.api.Close)
+	return s
+}
+
+func (s *oauth2Server) endpoint(t *testing.T) HealthCheck {
+	return prepareEndpoint(t, HealthCheck{Name: "api", URL: s.api.URL, OAuth2: &OAuth2{
+		TokenURL: s.tokens.URL, ClientID: "client", ClientSecret: "s3cret", Scopes: []string{"read", "write"},
+	}}, testOptions())
+}
+
+func (s *oauth2Server) requests() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.issued
+}
+
+func TestOAuth2TokenCaching(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn string
+		want      int // Token requests for 3 checks
+	}{
+		{"valid for an hour", "3600", 1},
+		{"no expiry", "", 1},
+		{"expires within the margin", "5", 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newOAuth2Server(t)
+			s.expiresIn = test.expiresIn
+			site := s.endpoint(t)
+			for i := 0; i < 3; i++ {
+				if res := Check(context.Background(), site); !res.Up {
+					t.Fatalf("check %d: Up = false (err: %v)", i+1, res.Err)
+				}
+			}
+			if got := s.requests(); got != test.want {
+				t.Errorf("%d token requests, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOAuth2TokenSharedByConcurrentChecks(t *testing.T) {
+	s := newOAuth2Server(t)
+	s.expiresIn = "3600"
+	site := s.endpoint(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res := Check(context.Background(), site); !res.Up {
+				t.Errorf("Up = false (err: %v)", res.Err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := s.requests(); got != 1 {
+		t.Errorf("%d token requests, want 1 shared by every check", got)
+	}
+}
+
+func TestOAuth2TokenRejected(t *testing.T) {
+	s := newOAuth2Server(t)
+	s.expiresIn = "3600"
+	site := s.endpoint(t)
+	Check(context.Background(), site)
+
+	// A revoked token makes the check DOWN, and is replaced by the next one
+	s.lock.Lock()
+	s.revoked = true
+	s.lock.Unlock()
+	if res := Check(context.Background(), site); res.Up || res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Up, StatusCode = %t, %d, want false, 401", res.Up, res.StatusCode)
+	}
+	if res := Check(context.Background(), site); !res.Up {
+		t.Errorf("Up = false after the token was revoked, want a new one (err: %v)", res.Err)
+	}
+	if got := s.requests(); got != 2 {
+		t.Errorf("%d token requests, want 2", got)
+	}
+
+	// Once the token is rejected, a failing token endpoint fails the check
+	s.lock.Lock()
+	s.fail, s.revoked = true, true
+	s.lock.Unlock()
+	Check(context.Background(), site)
+	res := Check(context.Background(), site)
+	if res.Up || res.Category != "oauth2" || !strings.Contains(res.Err.Error(), "invalid_client") {
+		t.Errorf("Up, Category, Err = %t, %q, %v, want DOWN with the token endpoint's error", res.Up, res.Category, res.Err)
+	}
+}